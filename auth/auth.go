@@ -0,0 +1,202 @@
+/*
+Package auth restricts which clients may use pacyak.
+
+Clients can be limited by source address and required to send Basic credentials for users in an htpasswd file.
+Passwords may be bcrypt ($2y$) or SHA1 ({SHA}) hashed; other htpasswd formats are rejected.
+*/
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultRealm is sent in authentication challenges if Opts.Realm is not set
+const DefaultRealm = "pacyak"
+
+// Opts configures client access as it appears in the config file
+type Opts struct {
+	// Clients are the CIDRs (or addresses) clients may connect from. Empty allows any client.
+	Clients []string `json:"clients,omitempty"`
+	// Htpasswd is the path of an htpasswd file. If set clients must authenticate as one of its users.
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Realm is sent in authentication challenges. Defaults to DefaultRealm.
+	Realm string `json:"realm,omitempty"`
+}
+
+// Authenticator checks clients against Opts. A nil Authenticator allows everything.
+type Authenticator struct {
+	clients []*net.IPNet
+	users   map[string]string
+	realm   string
+
+	// verified holds digests of credentials that have passed; bcrypt is too slow to run on every request
+	verified map[[sha256.Size]byte]bool
+	lock     sync.Mutex
+}
+
+// New builds an Authenticator, reading the htpasswd file if one is set
+func New(opts Opts) (*Authenticator, error) {
+	a := &Authenticator{
+		realm:    opts.Realm,
+		verified: make(map[[sha256.Size]byte]bool),
+	}
+
+	if a.realm == "" {
+		a.realm = DefaultRealm
+	}
+
+	for _, client := range opts.Clients {
+		if !strings.Contains(client, "/") {
+			if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+				client += "/32"
+			} else {
+				client += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client CIDR '%s'", client)
+		}
+		a.clients = append(a.clients, n)
+	}
+
+	if opts.Htpasswd != "" {
+		file, err := os.Open(opts.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if a.users, err = ParseHtpasswd(file); err != nil {
+			return nil, fmt.Errorf("Error reading %s: %s", opts.Htpasswd, err)
+		}
+	}
+
+	return a, nil
+}
+
+// ParseHtpasswd reads "user:hash" lines, skipping blanks and # comments
+func ParseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid entry on line %d", line)
+		}
+
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("Unsupported hash for user '%s' on line %d; use bcrypt (htpasswd -B)", parts[0], line)
+		}
+
+		users[parts[0]] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+// Realm returns the realm to send in authentication challenges
+func (a *Authenticator) Realm() string {
+	if a == nil {
+		return DefaultRealm
+	}
+	return a.realm
+}
+
+// AllowClient reports whether a client at ip may connect
+func (a *Authenticator) AllowClient(ip net.IP) bool {
+	if a == nil || len(a.clients) == 0 {
+		return true
+	}
+
+	for _, n := range a.clients {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequiresAuth reports whether clients must send credentials
+func (a *Authenticator) RequiresAuth() bool {
+	return a != nil && a.users != nil
+}
+
+// Authenticate checks a Basic authorization header value. It returns the user name if the credentials are valid.
+func (a *Authenticator) Authenticate(header string) (string, bool) {
+	if !a.RequiresAuth() {
+		return "", true
+	}
+
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	user, password := parts[0], parts[1]
+
+	hash, ok := a.users[user]
+	if !ok {
+		return "", false
+	}
+
+	digest := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+
+	a.lock.Lock()
+	verified := a.verified[digest]
+	a.lock.Unlock()
+
+	if verified {
+		return user, true
+	}
+
+	if !checkPassword(hash, password) {
+		return "", false
+	}
+
+	a.lock.Lock()
+	a.verified[digest] = true
+	a.lock.Unlock()
+
+	return user, true
+}
+
+func checkPassword(hash string, password string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,116 @@
+package auth_test
+
+import (
+	. "github.com/mikesimons/pacyak/auth"
+
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Auth", func() {
+	basic := func(user, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	}
+
+	Describe("AllowClient", func() {
+		It("should allow any client without a client list", func() {
+			it, _ := New(Opts{})
+			Expect(it.AllowClient(net.ParseIP("203.0.113.1"))).Should(BeTrue())
+
+			var none *Authenticator
+			Expect(none.AllowClient(net.ParseIP("203.0.113.1"))).Should(BeTrue())
+		})
+
+		It("should only allow listed clients", func() {
+			it, err := New(Opts{Clients: []string{"10.0.0.0/8", "::1", "127.0.0.1"}})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(it.AllowClient(net.ParseIP("10.1.2.3"))).Should(BeTrue())
+			Expect(it.AllowClient(net.ParseIP("::1"))).Should(BeTrue())
+			Expect(it.AllowClient(net.ParseIP("127.0.0.1"))).Should(BeTrue())
+			Expect(it.AllowClient(net.ParseIP("192.168.1.1"))).Should(BeFalse())
+			Expect(it.AllowClient(nil)).Should(BeFalse())
+		})
+
+		It("should reject invalid CIDRs", func() {
+			_, err := New(Opts{Clients: []string{"10.0.0.0/33"}})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("ParseHtpasswd", func() {
+		It("should parse bcrypt and SHA entries", func() {
+			users, err := ParseHtpasswd(strings.NewReader("# users\nalice:$2y$05$abc\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(users).Should(HaveLen(2))
+		})
+
+		It("should reject unsupported hashes and invalid lines", func() {
+			_, err := ParseHtpasswd(strings.NewReader("alice:$apr1$salt$hash\n"))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = ParseHtpasswd(strings.NewReader("alice\n"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Authenticate", func() {
+		var it *Authenticator
+
+		BeforeEach(func() {
+			hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+			file, _ := ioutil.TempFile("", "pacyak-htpasswd")
+			defer os.Remove(file.Name())
+			file.WriteString("alice:" + string(hash) + "\n")
+			// "password"
+			file.WriteString("bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+			file.Close()
+
+			var err error
+			it, err = New(Opts{Htpasswd: file.Name()})
+			Expect(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should accept valid credentials", func() {
+			Expect(it.RequiresAuth()).Should(BeTrue())
+
+			user, ok := it.Authenticate(basic("alice", "secret"))
+			Expect(ok).Should(BeTrue())
+			Expect(user).Should(Equal("alice"))
+
+			// Second time round is served from the verified cache
+			_, ok = it.Authenticate(basic("alice", "secret"))
+			Expect(ok).Should(BeTrue())
+
+			_, ok = it.Authenticate(basic("bob", "password"))
+			Expect(ok).Should(BeTrue())
+		})
+
+		It("should reject invalid credentials", func() {
+			_, ok := it.Authenticate(basic("alice", "wrong"))
+			Expect(ok).Should(BeFalse())
+
+			_, ok = it.Authenticate(basic("mallory", "secret"))
+			Expect(ok).Should(BeFalse())
+
+			_, ok = it.Authenticate("")
+			Expect(ok).Should(BeFalse())
+
+			_, ok = it.Authenticate("Bearer abc")
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should return an error for a missing htpasswd file", func() {
+			_, err := New(Opts{Htpasswd: "/does/not/exist"})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
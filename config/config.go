@@ -0,0 +1,184 @@
+/*
+Package config loads the pacyak config file.
+
+The file is JSON:
+
+	{
+	  "no_proxy": "localhost,127.0.0.0/8,::1",
+	  "rules": [
+	    {"hosts": ["staging.corp"], "action": "DIRECT"},
+	    {"hosts": ["*.partner.com"], "action": "PROXY partner.proxy:3128"},
+	    {"hosts": ["*.ads.example"], "action": "BLOCK"},
+	    {"hosts": ["*.vpn.corp"], "action": "DIRECT", "interface": "tun0"}
+	  ],
+	  "policy": {
+	    "deny": ["*.telemetry.example", "10.0.0.0/8"],
+	    "connect_ports": [443, 22]
+	  },
+	  "auth": {
+	    "clients": ["127.0.0.1", "192.168.56.0/24"],
+	    "htpasswd": "/etc/pacyak/htpasswd"
+	  },
+	  "upstreams": {
+	    "proxy.corp:8080": {"forward_auth": true, "http2": true},
+	    "secure.proxy.corp:443": {"tls": {"ca_file": "/etc/pacyak/corp-ca.pem"}},
+	    "direct": {"interface": "wlan0"}
+	  },
+	  "dns": {
+	    "servers": ["https://cloudflare-dns.com/dns-query"],
+	    "domains": {"corp.example": ["10.0.0.53", "tls://10.0.0.54"]},
+	    "hosts": {"proxy.corp": ["10.0.0.1"]},
+	    "tls": {"ca_file": "/etc/pacyak/corp-ca.pem"}
+	  }
+	}
+*/
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/mikesimons/pacyak/auth"
+	"github.com/mikesimons/pacyak/policy"
+	"github.com/mikesimons/pacyak/proxy"
+	"github.com/mikesimons/pacyak/resolver"
+	"github.com/mikesimons/pacyak/rules"
+	"github.com/mikesimons/pacyak/tlsconfig"
+)
+
+// Config is the content of the config file
+type Config struct {
+	// NoProxy is a NO_PROXY style list of destinations that always go direct. It is checked before Rules.
+	NoProxy string `json:"no_proxy,omitempty"`
+	// Rules are routing exceptions checked in order before the PAC
+	Rules []rules.Rule `json:"rules,omitempty"`
+	// Policy restricts the destinations that can be reached at all
+	Policy policy.Policy `json:"policy"`
+	// Auth restricts which clients may use pacyak
+	Auth auth.Opts `json:"auth"`
+	// Upstreams holds settings for individual upstream proxies keyed by host:port as given in the PAC, or "direct"
+	Upstreams map[string]Upstream `json:"upstreams,omitempty"`
+	// DNS sets how pacyak resolves destinations of direct connections and the names of upstream proxies
+	DNS DNS `json:"dns"`
+}
+
+// DNS holds the resolver settings. TLS sets the CA bundle and client certificate for DNS-over-TLS and
+// DNS-over-HTTPS servers.
+type DNS struct {
+	resolver.Opts
+	TLS tlsconfig.Opts `json:"tls"`
+}
+
+// Upstream holds settings for an upstream proxy. Unset fields take the listener's setting.
+type Upstream struct {
+	// ForwardAuth passes client Proxy-Authorization headers to this proxy
+	ForwardAuth *bool `json:"forward_auth,omitempty"`
+	// HTTP2 multiplexes CONNECT tunnels to this proxy over HTTP/2
+	HTTP2 *bool `json:"http2,omitempty"`
+	// TLS sets the CA bundle and client certificate for an https proxy
+	TLS tlsconfig.Opts `json:"tls"`
+	// Interface and SourceAddress bind connections to this proxy. Under the "direct" key they bind DIRECT connections.
+	Interface     string `json:"interface,omitempty"`
+	SourceAddress string `json:"source_address,omitempty"`
+}
+
+// ProxyOpts returns the options for each upstream given the listener defaults.
+// It returns an error if an upstream's TLS files can't be loaded.
+func (c *Config) ProxyOpts(defaults proxy.Opts) (map[string]proxy.Opts, error) {
+	upstreams := make(map[string]proxy.Opts)
+
+	for host, upstream := range c.Upstreams {
+		opts := defaults
+		if upstream.ForwardAuth != nil {
+			opts.ForwardAuth = *upstream.ForwardAuth
+		}
+		if upstream.HTTP2 != nil {
+			opts.HTTP2 = *upstream.HTTP2
+		}
+		if upstream.SourceAddress != "" && net.ParseIP(upstream.SourceAddress) == nil {
+			return nil, fmt.Errorf("Invalid source address '%s' for upstream %s", upstream.SourceAddress, host)
+		}
+		if upstream.Interface != "" || upstream.SourceAddress != "" {
+			opts.Bind = proxy.Binding{Interface: upstream.Interface, SourceAddress: upstream.SourceAddress}
+		}
+		if !upstream.TLS.IsZero() {
+			config, err := tlsconfig.Load(upstream.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid TLS settings for upstream %s: %s", host, err)
+			}
+			opts.TLSConfig = config
+		}
+		upstreams[host] = opts
+	}
+
+	return upstreams, nil
+}
+
+// Load reads and validates the config file at path
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse decodes and validates config file content
+func Parse(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Error parsing config: %s", err)
+	}
+
+	if _, err := config.CompileRules(); err != nil {
+		return nil, err
+	}
+
+	if _, err := policy.Compile(config.Policy); err != nil {
+		return nil, err
+	}
+
+	if _, err := auth.New(config.Auth); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.Resolver(nil); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Resolver returns the resolver for outgoing connections, or nil if the DNS section leaves it to the system.
+// Encrypted DNS servers use tlsDefault unless the section has its own TLS settings.
+func (c *Config) Resolver(tlsDefault *tls.Config) (resolver.Resolver, error) {
+	if c.DNS.IsZero() {
+		return nil, nil
+	}
+
+	opts := c.DNS.Opts
+	opts.TLSConfig = tlsDefault
+	if !c.DNS.TLS.IsZero() {
+		config, err := tlsconfig.Load(c.DNS.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DNS TLS settings: %s", err)
+		}
+		opts.TLSConfig = config
+	}
+
+	r, err := resolver.NewWithOpts(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNS settings: %s", err)
+	}
+	return r, nil
+}
+
+// CompileRules returns the NoProxy list and Rules as one rule list
+func (c *Config) CompileRules() (*rules.Rules, error) {
+	all := append(rules.FromNoProxy(c.NoProxy), c.Rules...)
+	return rules.Compile(all)
+}
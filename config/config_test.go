@@ -0,0 +1,150 @@
+package config_test
+
+import (
+	. "github.com/mikesimons/pacyak/config"
+	"github.com/mikesimons/pacyak/proxy"
+	"github.com/mikesimons/pacyak/rules"
+
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Describe("Parse", func() {
+		It("should parse rules and no_proxy", func() {
+			it, err := Parse([]byte(`{
+				"no_proxy": "localhost",
+				"rules": [{"hosts": ["*.partner.com"], "action": "PROXY partner.proxy:3128"}]
+			}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			compiled, err := it.CompileRules()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(compiled.Evaluate(rules.Request{Host: "localhost"})).Should(Equal("DIRECT"))
+			Expect(compiled.Evaluate(rules.Request{Host: "www.partner.com"})).Should(Equal("PROXY partner.proxy:3128"))
+		})
+
+		It("should parse the policy", func() {
+			it, err := Parse([]byte(`{"policy": {"deny": ["*.telemetry.example"], "connect_ports": [443]}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(it.Policy.Deny).Should(Equal([]string{"*.telemetry.example"}))
+			Expect(it.Policy.ConnectPorts).Should(Equal([]int{443}))
+		})
+
+		It("should merge upstream settings with the defaults", func() {
+			it, err := Parse([]byte(`{"upstreams": {"a.proxy:8080": {"forward_auth": true, "http2": true, "interface": "tun0"}, "b.proxy:8080": {}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			upstreams, err := it.ProxyOpts(proxy.Opts{})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(upstreams["a.proxy:8080"].ForwardAuth).Should(BeTrue())
+			Expect(upstreams["a.proxy:8080"].HTTP2).Should(BeTrue())
+			Expect(upstreams["a.proxy:8080"].Bind).Should(Equal(proxy.Binding{Interface: "tun0"}))
+			Expect(upstreams["b.proxy:8080"].ForwardAuth).Should(BeFalse())
+			Expect(upstreams["b.proxy:8080"].HTTP2).Should(BeFalse())
+
+			upstreams, _ = it.ProxyOpts(proxy.Opts{ForwardAuth: true})
+			Expect(upstreams["b.proxy:8080"].ForwardAuth).Should(BeTrue())
+			Expect(upstreams["b.proxy:8080"].TLSConfig).Should(BeNil())
+			Expect(upstreams["b.proxy:8080"].Bind.IsZero()).Should(BeTrue())
+		})
+
+		It("should return an error for an invalid upstream source address", func() {
+			it, err := Parse([]byte(`{"upstreams": {"a.proxy:8080": {"source_address": "10.0.0.300"}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = it.ProxyOpts(proxy.Opts{})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should return an error for upstream TLS files that can't be loaded", func() {
+			it, err := Parse([]byte(`{"upstreams": {"a.proxy:443": {"tls": {"ca_file": "/nonexistent/ca.pem"}}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = it.ProxyOpts(proxy.Opts{})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should parse the DNS settings", func() {
+			it, err := Parse([]byte(`{"dns": {"domains": {"corp.example": ["10.0.0.53"]}, "hosts": {"proxy.corp": ["10.0.0.1"]}}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			resolver, err := it.Resolver(nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(resolver.LookupHost(context.Background(), "proxy.corp")).Should(Equal([]string{"10.0.0.1"}))
+
+			it, _ = Parse([]byte(`{}`))
+			Expect(it.Resolver(nil)).Should(BeNil())
+		})
+
+		It("should use the default TLS settings for encrypted DNS servers", func() {
+			queried := make(chan struct{}, 10)
+			doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queried <- struct{}{}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer doh.Close()
+
+			it, err := Parse([]byte(`{"dns": {"servers": ["` + doh.URL + `"], "cache_ttl": -1}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+
+			untrusted, _ := it.Resolver(nil)
+			untrusted.LookupHost(context.Background(), "host.doh.test")
+			Expect(queried).ShouldNot(Receive())
+
+			trusted, _ := it.Resolver(doh.Client().Transport.(*http.Transport).TLSClientConfig)
+			trusted.LookupHost(context.Background(), "host.doh.test")
+			Expect(queried).Should(Receive())
+		})
+
+		It("should return an error for DNS TLS files that can't be loaded", func() {
+			it, err := Parse([]byte(`{"dns": {"servers": ["https://dns.corp/dns-query"], "tls": {"ca_file": "/nonexistent/ca.pem"}}}`))
+			Expect(err).Should(HaveOccurred())
+			Expect(it).Should(BeNil())
+		})
+
+		It("should return an error for invalid JSON or rules", func() {
+			_, err := Parse([]byte(`{"rules": [`))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Parse([]byte(`{"rules": [{"hosts": ["example.com"]}]}`))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Parse([]byte(`{"policy": {"deny": ["10.0.0.0/33"]}}`))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Parse([]byte(`{"auth": {"htpasswd": "/does/not/exist"}}`))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Parse([]byte(`{"dns": {"servers": ["dns.example"]}}`))
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Parse([]byte(`{"dns": {"hosts": {"proxy.corp": ["proxy.example"]}}}`))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Load", func() {
+		It("should load a config file", func() {
+			file, _ := ioutil.TempFile("", "pacyak-config")
+			defer os.Remove(file.Name())
+			file.WriteString(`{"no_proxy": "localhost"}`)
+			file.Close()
+
+			it, err := Load(file.Name())
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(it.NoProxy).Should(Equal("localhost"))
+		})
+
+		It("should return an error for a missing file", func() {
+			_, err := Load("/does/not/exist.json")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
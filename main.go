@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mikesimons/earl"
+	"github.com/mikesimons/pacyak/pacsandbox"
+	"github.com/mikesimons/pacyak/proxy"
+	"github.com/mikesimons/pacyak/resolver"
+	"github.com/mikesimons/pacyak/server"
+	"github.com/mikesimons/pacyak/sshconfig"
+	"github.com/mikesimons/pacyak/tlsconfig"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -37,6 +50,131 @@ OPTIONS:
 			Name:  "pac-proxy",
 			Usage: "Proxy for pac file. (Only necessary if your PAC location requires a proxy to be set)",
 		},
+		cli.DurationFlag{
+			Name:  "pac-timeout",
+			Usage: "Maximum time a single PAC evaluation may take",
+			Value: pacsandbox.DefaultTimeout,
+		},
+		cli.StringFlag{
+			Name:  "pac-fallback",
+			Usage: "PAC result to use if evaluation fails or times out (e.g. \"PROXY my-proxy:8080\")",
+			Value: "DIRECT",
+		},
+		cli.StringFlag{
+			Name:  "pac-engine",
+			Usage: fmt.Sprintf("JavaScript engine used to run the PAC (%s)", strings.Join(pacsandbox.Engines(), ", ")),
+			Value: pacsandbox.DefaultEngine,
+		},
+		cli.StringFlag{
+			Name:  "pac-cache-key",
+			Usage: "Granularity PAC results are cached at (host, path, url). Use path or url if PAC rules look at the path",
+			Value: pacsandbox.CacheKeyHost,
+		},
+		cli.BoolFlag{
+			Name:  "pac-strip-path",
+			Usage: "Hide the path and query of https URLs from the PAC, as browsers do",
+		},
+		cli.DurationFlag{
+			Name:  "pac-cache-ttl",
+			Usage: "How long PAC results are cached",
+			Value: pacsandbox.DefaultResultTTL,
+		},
+		cli.DurationFlag{
+			Name:  "pac-error-ttl",
+			Usage: "How long PAC evaluation errors are cached (negative to disable)",
+			Value: pacsandbox.DefaultErrorTTL,
+		},
+		cli.IntFlag{
+			Name:  "pac-cache-size",
+			Usage: "Maximum number of cached PAC results",
+			Value: pacsandbox.DefaultCacheSize,
+		},
+		cli.DurationFlag{
+			Name:  "dns-cache-ttl",
+			Usage: "How long dnsResolve results are cached",
+			Value: pacsandbox.DefaultDNSTTL,
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-server",
+			Usage: "DNS server used by the PAC dnsResolve / isResolvable functions (ip[:port], tls://host[:port] or an https:// URL; may be repeated). Defaults to the dns section of the config, then the system resolver.",
+		},
+		cli.DurationFlag{
+			Name:  "dns-timeout",
+			Usage: "Maximum time a single PAC DNS lookup may take",
+			Value: pacsandbox.DefaultDNSTimeout,
+		},
+		cli.StringFlag{
+			Name:  "pac-overlay",
+			Usage: "JavaScript file or URL loaded after the PAC. Its FindProxyForURL can call the PAC's as CorporateFindProxyForURL.",
+		},
+		cli.BoolFlag{
+			Name:  "forward-proxy-auth",
+			Usage: "Pass client Proxy-Authorization headers to upstream proxies and relay their 407 challenges",
+		},
+		cli.BoolFlag{
+			Name:  "via",
+			Usage: "Add pacyak to the Via header of proxied requests and responses",
+		},
+		cli.BoolFlag{
+			Name:  "x-forwarded-for",
+			Usage: "Append the client address to the X-Forwarded-For header of proxied HTTP requests",
+		},
+		cli.DurationFlag{
+			Name:  "tunnel-idle-timeout",
+			Usage: "Close CONNECT and WebSocket tunnels that carry no data for this long (0 means never)",
+		},
+		cli.BoolFlag{
+			Name:  "http2",
+			Usage: "Accept HTTP/2 from clients (h2c, or negotiated over TLS with --tls-cert)",
+		},
+		cli.BoolFlag{
+			Name:  "upstream-http2",
+			Usage: "Multiplex CONNECT tunnels over HTTP/2 connections to upstream proxies",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Certificate file to serve the listener over TLS (requires --tls-key)",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key file for --tls-cert",
+		},
+		cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "PEM bundle of CA certificates to trust (with the system roots) for HTTPS proxies and the PAC server",
+		},
+		cli.StringFlag{
+			Name:  "client-cert",
+			Usage: "Client certificate to present to HTTPS proxies and the PAC server (requires --client-key)",
+		},
+		cli.StringFlag{
+			Name:  "client-key",
+			Usage: "Private key file for --client-cert",
+		},
+		cli.StringFlag{
+			Name:  "ssh-known-hosts",
+			Usage: "known_hosts file SSH bastions are checked against (default: ~/.ssh/known_hosts)",
+		},
+		cli.StringSliceFlag{
+			Name:  "ssh-identity",
+			Usage: "Private key for SSH bastions, used after keys in the SSH agent (default: ~/.ssh/id_*)",
+		},
+		cli.StringFlag{
+			Name:  "interface",
+			Usage: "Network interface outgoing connections (direct or to upstream proxies) leave from",
+		},
+		cli.StringFlag{
+			Name:  "source-address",
+			Usage: "Local IP address outgoing connections are made from",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "JSON config file holding routing rules checked before the PAC. Reloaded on SIGHUP.",
+		},
+		cli.StringFlag{
+			Name:  "my-ip-address",
+			Usage: "Address returned by the PAC myIpAddress function (default: source address of the route to the ping host)",
+		},
 		cli.StringFlag{
 			Name:  "log-level",
 			Usage: "Log level (debug, info, warn, error)",
@@ -45,13 +183,13 @@ OPTIONS:
 	}
 
 	app.Action = func(c *cli.Context) error {
-		opts := &PacYakOpts{}
+		opts := &server.Opts{}
 
 		tmp, err := logrus.ParseLevel(c.String("log-level"))
 		if err != nil {
 			return cli.NewExitError(fmt.Sprintf("Invalid log level '%s'. Valid levels are: debug, info, warn, error", tmp), 1)
 		}
-		opts.LogLevel = tmp
+		logrus.SetLevel(tmp)
 
 		if c.NArg() < 1 {
 			cli.ShowAppHelp(c)
@@ -78,10 +216,114 @@ OPTIONS:
 
 		opts.PacProxy = c.String("pac-proxy")
 		opts.ListenAddr = c.String("listen")
+		opts.MyIPAddress = c.String("my-ip-address")
+		opts.ConfigFile = c.String("config")
+		opts.ForwardProxyAuth = c.Bool("forward-proxy-auth")
+		opts.AddVia = c.Bool("via")
+		opts.AddForwardedFor = c.Bool("x-forwarded-for")
+		opts.TunnelIdleTimeout = c.Duration("tunnel-idle-timeout")
+		opts.HTTP2 = c.Bool("http2")
+		opts.UpstreamHTTP2 = c.Bool("upstream-http2")
+		opts.TLSCertFile = c.String("tls-cert")
+		opts.TLSKeyFile = c.String("tls-key")
+		opts.PacOverlay = c.String("pac-overlay")
+		opts.PacOpts = pacsandbox.Opts{
+			Timeout:    c.Duration("pac-timeout"),
+			Fallback:   c.String("pac-fallback"),
+			Engine:     c.String("pac-engine"),
+			CacheKey:   c.String("pac-cache-key"),
+			StripPath:  c.Bool("pac-strip-path"),
+			ResultTTL:  c.Duration("pac-cache-ttl"),
+			ErrorTTL:   c.Duration("pac-error-ttl"),
+			CacheSize:  c.Int("pac-cache-size"),
+			DNSTTL:     c.Duration("dns-cache-ttl"),
+			DNSTimeout: c.Duration("dns-timeout"),
+		}
 
-		Run(opts)
-		return nil
+		if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+			return cli.NewExitError("--tls-cert and --tls-key must be given together", 1)
+		}
+
+		opts.Bind = proxy.Binding{Interface: c.String("interface"), SourceAddress: c.String("source-address")}
+		if opts.Bind.SourceAddress != "" && net.ParseIP(opts.Bind.SourceAddress) == nil {
+			return cli.NewExitError(fmt.Sprintf("Invalid source address '%s'", opts.Bind.SourceAddress), 1)
+		}
+		// As with bindings in the config, the interface may be a VPN tunnel that isn't up yet
+		if err := server.ValidateBinding(opts.Bind); err != nil {
+			logrus.WithFields(logrus.Fields{"error": err}).Warn("Outgoing connections will fail until the interface is available")
+		}
+
+		tlsConfig, err := tlsconfig.Load(tlsconfig.Opts{
+			CAFile:   c.String("ca-file"),
+			CertFile: c.String("client-cert"),
+			KeyFile:  c.String("client-key"),
+		})
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		opts.UpstreamTLSConfig = tlsConfig
+		opts.PacTLSConfig = tlsConfig
+
+		if servers := c.StringSlice("dns-server"); len(servers) > 0 {
+			pacResolver, err := resolver.NewServers(servers, tlsConfig)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			opts.PacOpts.Resolver = pacResolver
+		}
+
+		sshConfig, err := sshconfig.Load(sshconfig.Opts{
+			KnownHosts:    c.String("ssh-known-hosts"),
+			IdentityFiles: c.StringSlice("ssh-identity"),
+		})
+		if err == nil {
+			opts.UpstreamSSHConfig = sshConfig.ClientConfig
+		} else if c.IsSet("ssh-known-hosts") || c.IsSet("ssh-identity") {
+			return cli.NewExitError(err.Error(), 1)
+		} else {
+			logrus.WithFields(logrus.Fields{"error": err}).Debug("SSH upstreams unavailable")
+		}
+
+		if _, err := pacsandbox.NewEngine(opts.PacOpts.Engine); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		return run(opts)
 	}
 
 	app.Run(os.Args)
 }
+
+// run starts the server and blocks until it is stopped by SIGINT / SIGTERM. SIGHUP reloads the config file.
+func run(opts *server.Opts) error {
+	srv := server.New(opts)
+
+	if err := srv.Reload(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("Invalid config: %s", err), 1)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			srv.Reload()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.WithFields(logrus.Fields{"signal": sig}).Info("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package pacsandbox
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// DefaultEngine is the JavaScript engine used if Opts.Engine is not set
+const DefaultEngine = "otto"
+
+// Builtin is a Go function exposed to PAC scripts.
+// Arguments are converted to strings with undefined becoming "". A nil return value is null in the script.
+// An error aborts the evaluation; ProxyFor returns it along with the fallback result.
+type Builtin func(ctx context.Context, args []string) (interface{}, error)
+
+// Engine is a JavaScript runtime that can run a PAC script
+// An Engine is not safe for concurrent use; PacSandbox gives each evaluation an engine of its own
+type Engine interface {
+	// Load runs script in the global scope
+	Load(script string) error
+	// Defined reports whether name is a function in the global scope
+	Defined(name string) bool
+	// Register exposes builtin to scripts as a global function that takes at least arity arguments
+	Register(name string, arity int, builtin Builtin)
+	// Call invokes the global function name and returns its result as a string
+	// ctx is handed to any builtins the function calls
+	Call(ctx context.Context, name string, args ...string) (string, error)
+	// Interrupt aborts a running Load or Call, which then fails with err. It may be called from any goroutine.
+	Interrupt(err error)
+	// Clone returns an independent engine with the same builtins and loaded scripts. Engines that have to run the
+	// scripts again do so in the clone's first Call, which fails if they do.
+	Clone() (Engine, error)
+}
+
+// NotEnoughArgumentsError is used where a JS call has been marshalled to go wthout enough args
+type NotEnoughArgumentsError struct {
+	got      int
+	expected int
+	function string
+}
+
+func (e *NotEnoughArgumentsError) Error() string {
+	return fmt.Sprintf("Not enough arguments provided to %s. Got %d, expected %d", e.function, e.got, e.expected)
+}
+
+var engines = map[string]func() Engine{
+	"otto": newOttoEngine,
+	"goja": newGojaEngine,
+}
+
+// Engines returns the names of the available JavaScript engines
+func Engines() []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEngine creates an engine by name; see Engines
+func NewEngine(name string) (Engine, error) {
+	constructor, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown JavaScript engine '%s'. Available engines are: %v", name, Engines())
+	}
+
+	return constructor(), nil
+}
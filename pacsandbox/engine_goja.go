@@ -0,0 +1,167 @@
+package pacsandbox
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dop251/goja"
+)
+
+// gojaEngine is an Engine backed by github.com/dop251/goja
+type gojaEngine struct {
+	rt       *goja.Runtime
+	ctx      context.Context
+	builtins []registeredBuiltin
+	programs []*goja.Program
+
+	// pending are the programs a clone has yet to run. They run at the start of its first Call so that a script
+	// that is slow to load is stopped by the same timeout as the evaluation.
+	pending []*goja.Program
+}
+
+func newGojaEngine() Engine {
+	return &gojaEngine{
+		rt:  goja.New(),
+		ctx: context.Background(),
+	}
+}
+
+// Load compiles script once so clones can run the program without parsing it again
+func (e *gojaEngine) Load(script string) error {
+	if err := e.runPending(); err != nil {
+		return err
+	}
+
+	program, err := goja.Compile("", script, false)
+	if err != nil {
+		return err
+	}
+
+	return e.run(program)
+}
+
+// run runs a compiled script and keeps it for clones
+func (e *gojaEngine) run(program *goja.Program) error {
+	if _, err := e.rt.RunProgram(program); err != nil {
+		return gojaError(err)
+	}
+
+	e.programs = append(e.programs, program)
+	return nil
+}
+
+// runPending runs the programs a clone has yet to run
+func (e *gojaEngine) runPending() error {
+	for len(e.pending) > 0 {
+		program := e.pending[0]
+		e.pending = e.pending[1:]
+
+		if err := e.run(program); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *gojaEngine) Defined(name string) bool {
+	if e.runPending() != nil {
+		return false
+	}
+
+	_, ok := goja.AssertFunction(e.rt.Get(name))
+	return ok
+}
+
+func (e *gojaEngine) Register(name string, arity int, builtin Builtin) {
+	e.builtins = append(e.builtins, registeredBuiltin{name: name, arity: arity, builtin: builtin})
+	e.set(name, arity, builtin)
+}
+
+// set binds builtin into this engine's runtime
+// Errors are raised as Go panics which goja does not catch; PacSandbox recovers them
+func (e *gojaEngine) set(name string, arity int, builtin Builtin) {
+	e.rt.Set(name, func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < arity {
+			panic(&NotEnoughArgumentsError{function: name, got: len(call.Arguments), expected: arity})
+		}
+
+		var args []string
+		for _, arg := range call.Arguments {
+			if goja.IsUndefined(arg) {
+				args = append(args, "")
+				continue
+			}
+			args = append(args, arg.String())
+		}
+
+		ret, err := builtin(e.ctx, args)
+		if err != nil {
+			panic(err)
+		}
+
+		if ret == nil {
+			return goja.Null()
+		}
+
+		return e.rt.ToValue(ret)
+	})
+}
+
+func (e *gojaEngine) Call(ctx context.Context, name string, args ...string) (string, error) {
+	e.ctx = ctx
+	defer func() { e.ctx = context.Background() }()
+
+	if err := e.runPending(); err != nil {
+		return "", err
+	}
+
+	fn, ok := goja.AssertFunction(e.rt.Get(name))
+	if !ok {
+		return "", errors.New(name + " is not a function")
+	}
+
+	callArgs := make([]goja.Value, len(args))
+	for i, arg := range args {
+		callArgs[i] = e.rt.ToValue(arg)
+	}
+
+	result, err := fn(goja.Null(), callArgs...)
+	if err != nil {
+		return "", gojaError(err)
+	}
+
+	return result.String(), nil
+}
+
+func (e *gojaEngine) Interrupt(err error) {
+	e.rt.Interrupt(err)
+}
+
+// Clone builds a fresh runtime with the builtins and replays the compiled scripts on its first Call; goja has no way
+// to copy a runtime. Programs are immutable so clones share them.
+func (e *gojaEngine) Clone() (Engine, error) {
+	clone := &gojaEngine{
+		rt:       goja.New(),
+		ctx:      context.Background(),
+		builtins: append([]registeredBuiltin(nil), e.builtins...),
+		pending:  append(append([]*goja.Program(nil), e.programs...), e.pending...),
+	}
+
+	for _, b := range clone.builtins {
+		clone.set(b.name, b.arity, b.builtin)
+	}
+
+	return clone, nil
+}
+
+// gojaError unwraps interrupts so callers see the error passed to Interrupt
+func gojaError(err error) error {
+	if interrupted, ok := err.(*goja.InterruptedError); ok {
+		if cause, ok := interrupted.Value().(error); ok {
+			return cause
+		}
+	}
+
+	return err
+}
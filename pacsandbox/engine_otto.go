@@ -0,0 +1,130 @@
+package pacsandbox
+
+import (
+	"context"
+
+	"github.com/robertkrimen/otto"
+)
+
+// ottoEngine is an Engine backed by github.com/robertkrimen/otto
+type ottoEngine struct {
+	vm       *otto.Otto
+	ctx      context.Context
+	builtins []registeredBuiltin
+}
+
+type registeredBuiltin struct {
+	name    string
+	arity   int
+	builtin Builtin
+}
+
+func newOttoEngine() Engine {
+	vm := otto.New()
+	vm.Interrupt = make(chan func(), 1)
+
+	return &ottoEngine{
+		vm:  vm,
+		ctx: context.Background(),
+	}
+}
+
+func (e *ottoEngine) Load(script string) error {
+	_, err := e.vm.Run(script)
+	return err
+}
+
+func (e *ottoEngine) Defined(name string) bool {
+	fn, err := e.vm.Get(name)
+	return err == nil && fn.IsFunction()
+}
+
+func (e *ottoEngine) Register(name string, arity int, builtin Builtin) {
+	e.builtins = append(e.builtins, registeredBuiltin{name: name, arity: arity, builtin: builtin})
+	e.set(name, arity, builtin)
+}
+
+// set binds builtin into this engine's VM
+// Errors are raised as Go panics which otto does not catch; PacSandbox recovers them
+func (e *ottoEngine) set(name string, arity int, builtin Builtin) {
+	e.vm.Set(name, func(call otto.FunctionCall) otto.Value {
+		if len(call.ArgumentList) < arity {
+			panic(&NotEnoughArgumentsError{function: name, got: len(call.ArgumentList), expected: arity})
+		}
+
+		var args []string
+		for _, arg := range call.ArgumentList {
+			if arg.IsUndefined() {
+				args = append(args, "")
+				continue
+			}
+
+			str, err := arg.ToString()
+			if err != nil {
+				panic(err)
+			}
+			args = append(args, str)
+		}
+
+		ret, err := builtin(e.ctx, args)
+		if err != nil {
+			panic(err)
+		}
+
+		if ret == nil {
+			return otto.NullValue()
+		}
+
+		value, err := call.Otto.ToValue(ret)
+		if err != nil {
+			panic(err)
+		}
+
+		return value
+	})
+}
+
+func (e *ottoEngine) Call(ctx context.Context, name string, args ...string) (string, error) {
+	e.ctx = ctx
+	defer func() { e.ctx = context.Background() }()
+
+	fn, err := e.vm.Get(name)
+	if err != nil {
+		return "", err
+	}
+
+	callArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		callArgs[i] = arg
+	}
+
+	result, err := fn.Call(otto.NullValue(), callArgs...)
+	if err != nil {
+		return "", err
+	}
+
+	return result.ToString()
+}
+
+func (e *ottoEngine) Interrupt(err error) {
+	select {
+	case e.vm.Interrupt <- func() { panic(err) }:
+	default:
+	}
+}
+
+// Clone copies the VM and rebinds the builtins so they see the clone's context
+func (e *ottoEngine) Clone() (Engine, error) {
+	clone := &ottoEngine{
+		vm:       e.vm.Copy(),
+		ctx:      context.Background(),
+		builtins: e.builtins,
+	}
+	clone.vm.Interrupt = make(chan func(), 1)
+
+	for _, b := range clone.builtins {
+		clone.set(b.name, b.arity, b.builtin)
+	}
+
+	return clone, nil
+}
@@ -0,0 +1,127 @@
+package pacsandbox
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheStats counts cache activity
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+}
+
+// lruCache is a fixed size least recently used cache that is safe for concurrent use
+// Entries optionally expire after a TTL; expired entries are dropped when next looked up
+type lruCache struct {
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List
+	stats CacheStats
+	lock  sync.Mutex
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// newLRUCache creates a cache holding at most size entries, each living for ttl (0 means forever)
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Get returns the value for key and marks it as most recently used
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	c.stats.Hits++
+	return entry.value, true
+}
+
+// Set stores value for key with the cache TTL
+func (c *lruCache) Set(key string, value interface{}) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL stores value for key, evicting the least recently used entry if the cache is full
+func (c *lruCache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// Len returns the number of entries in the cache
+func (c *lruCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *lruCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+// Purge removes all entries from the cache. Counters are kept.
+func (c *lruCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
@@ -0,0 +1,31 @@
+package pacsandbox
+
+import (
+	"net"
+	"time"
+)
+
+// defaultRouteTarget is used to find the default route's source address when no better host is known.
+// It is in TEST-NET-2 so it is never local; nothing is sent to it.
+const defaultRouteTarget = "198.51.100.1"
+
+// SourceAddress returns the local address the kernel would use to reach host, or 127.0.0.1 if it can't reach it.
+// Connecting a UDP socket only consults the routing table so no packets are sent.
+// Docker bridges and VPN tunnels mean the first interface address is often not the right answer for myIpAddress.
+func SourceAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+
+	conn, err := net.DialTimeout("udp", host, 2*time.Second)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsUnspecified() {
+		return addr.IP.String()
+	}
+
+	return "127.0.0.1"
+}
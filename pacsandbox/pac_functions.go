@@ -3,96 +3,114 @@ package pacsandbox
 // Reference: http://lxr.mozilla.org/seamonkey/source/netwerk/base/src/nsProxyAutoConfig.js#189
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"regexp"
 	"strings"
 
-	"github.com/robertkrimen/otto"
+	log "github.com/Sirupsen/logrus"
+	"github.com/mikesimons/pacyak/resolver"
 )
 
-func (p *PacSandbox) initPacFunctions() {
-	p.vm.Set("dnsResolve", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 1, "dnsResolve")
-		rval, err := p.dnsResolve(args[0])
+func (p *PacSandbox) initPacFunctions() error {
+	p.engine.Register("dnsResolve", 1, func(ctx context.Context, args []string) (interface{}, error) {
+		rval, err := p.dnsResolve(ctx, args[0])
 
 		if rval == "" {
-			return p.ottoRetValue(false, err)
+			return false, err
 		}
 
-		return p.ottoRetValue(rval, err)
+		return rval, err
 	})
 
-	p.vm.Set("dnsDomainIs", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 2, "dnsDomainIs")
-		return p.ottoRetValue(
-			p.dnsDomainIs(args[0], args[1]),
-		)
+	p.engine.Register("dnsDomainIs", 2, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.dnsDomainIs(args[0], args[1])
 	})
 
-	p.vm.Set("isResolvable", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 1, "isResolvable")
-		return p.ottoRetValue(
-			p.isResolvable(args[0]),
-		)
+	p.engine.Register("isResolvable", 1, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.isResolvable(ctx, args[0])
 	})
 
-	p.vm.Set("shExpMatch", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 2, "shExpMatch")
-		return p.ottoRetValue(
-			p.shExpMatch(args[0], args[1]),
-		)
+	p.engine.Register("shExpMatch", 2, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.shExpMatch(args[0], args[1])
 	})
 
-	p.vm.Set("isInNet", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 3, "isInNet")
-		return p.ottoRetValue(
-			p.isInNet(args[0], args[1], args[2]),
-		)
+	p.engine.Register("isInNet", 3, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.isInNet(args[0], args[1], args[2])
 	})
 
-	p.vm.Set("isPlainHostName", func(call otto.FunctionCall) otto.Value {
-		args := p.ottoStringArgs(call, 1, "isPlainHostName")
-		return p.ottoRetValue(
-			p.isPlainHostName(args[0]),
-		)
+	p.engine.Register("isPlainHostName", 1, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.isPlainHostName(args[0])
 	})
+
+	p.engine.Register("myIpAddress", 0, func(ctx context.Context, args []string) (interface{}, error) {
+		return p.opts.MyIPAddress(), nil
+	})
+
+	p.engine.Register("alert", 0, func(ctx context.Context, args []string) (interface{}, error) {
+		p.scriptLog.Log(ctx, "alert", args)
+		return nil, nil
+	})
+
+	p.engine.Register("__pacyakLog", 0, func(ctx context.Context, args []string) (interface{}, error) {
+		p.scriptLog.Log(ctx, "console.log", args)
+		return nil, nil
+	})
+
+	return p.engine.Load(consoleShim)
 }
 
 func (p *PacSandbox) dnsDomainIs(host string, domain string) (bool, error) {
 	return strings.HasSuffix(host, domain), nil
 }
 
-func (p *PacSandbox) dnsResolve(host string) (string, error) {
-	if cached, ok := p.cache.Get(host); ok {
-		return cached, nil
+// dnsResolve returns the IPv4 address of host where it has one, as browsers do, or "" if it can't be resolved.
+// Lookup failures are not errors to the PAC but running out of evaluation time is.
+func (p *PacSandbox) dnsResolve(ctx context.Context, host string) (string, error) {
+	if cached, ok := p.dnsCache.Get(host); ok {
+		return cached.(string), nil
 	}
 
 	if net.ParseIP(host) != nil {
 		return host, nil
 	}
 
-	result, err := net.LookupHost(host)
+	lookupCtx, cancel := context.WithTimeout(ctx, p.opts.DNSTimeout)
+	defer cancel()
+
+	result, err := p.opts.Resolver.LookupHost(lookupCtx, host)
+
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 
 	if err != nil {
+		log.WithFields(log.Fields{"host": host, "error": err}).Debug("PAC DNS lookup failed")
 		return "", nil
 	}
 
-	p.cache.Set(host, result[0])
-	return result[0], nil
+	address := resolver.PreferIPv4(result)
+	p.dnsCache.Set(host, address)
+	return address, nil
 }
 
-func (p *PacSandbox) isResolvable(host string) (bool, error) {
-	r, err := p.dnsResolve(host)
+func (p *PacSandbox) isResolvable(ctx context.Context, host string) (bool, error) {
+	r, err := p.dnsResolve(ctx, host)
 	return err == nil && r != "", nil
 }
 
 func (p *PacSandbox) shExpMatch(str string, pattern string) (bool, error) {
-	pattern = regexp.QuoteMeta(pattern)
-	pattern = strings.Replace(pattern, `\?`, ".", -1)
-	pattern = strings.Replace(pattern, `\*`, ".*", -1)
-	pattern = fmt.Sprintf("^%s$", pattern)
-	r := regexp.MustCompile(pattern)
+	if cached, ok := p.patterns.Get(pattern); ok {
+		return cached.(*regexp.Regexp).MatchString(str), nil
+	}
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = fmt.Sprintf("^%s$", expr)
+	r := regexp.MustCompile(expr)
+	p.patterns.Set(pattern, r)
 
 	return r.MatchString(str), nil
 }
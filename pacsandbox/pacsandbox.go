@@ -1,69 +1,405 @@
 package pacsandbox
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"runtime"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mikesimons/earl"
-	"github.com/robertkrimen/otto"
-	"github.com/wunderlist/ttlcache"
+	"github.com/mikesimons/pacyak/resolver"
 )
 
+// DefaultTimeout is the time a single PAC evaluation may take if Opts.Timeout is not set
+const DefaultTimeout = 5 * time.Second
+
+// patternCacheSize is the number of compiled shExpMatch patterns we keep
+const patternCacheSize = 512
+
+// Cache key granularities for Opts.CacheKey
+const (
+	// CacheKeyHost caches results per scheme, host and port. PAC rules that look at the path will misbehave.
+	CacheKeyHost = "host"
+	// CacheKeyPath caches results per scheme, host, port and path
+	CacheKeyPath = "path"
+	// CacheKeyURL caches results per full URL
+	CacheKeyURL = "url"
+)
+
+// Cache defaults used where Opts fields are not set
+const (
+	DefaultResultTTL    = 30 * time.Second
+	DefaultDNSTTL       = 5 * time.Minute
+	DefaultErrorTTL     = 5 * time.Second
+	DefaultCacheSize    = 4096
+	DefaultDNSCacheSize = 1024
+	DefaultDNSTimeout   = 2 * time.Second
+)
+
+// ErrTimeout is returned by ProxyFor when the PAC does not return within the timeout
+var ErrTimeout = errors.New("PAC evaluation timed out")
+
+// overlayPrelude renames the corporate PAC's entry points so an overlay can define its own and call them
+const overlayPrelude = `var CorporateFindProxyForURL = typeof FindProxyForURL == "function" ? FindProxyForURL : undefined;
+var CorporateFindProxyForURLEx = typeof FindProxyForURLEx == "function" ? FindProxyForURLEx : undefined;
+FindProxyForURL = undefined;
+FindProxyForURLEx = undefined;`
+
+// ErrNoEntryPoint is returned by New when the PAC defines neither FindProxyForURL nor FindProxyForURLEx
+var ErrNoEntryPoint = errors.New("PAC does not define a FindProxyForURL or FindProxyForURLEx function")
+
+// Opts holds configuration options for PacSandbox
+type Opts struct {
+	// Timeout bounds each PAC evaluation. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Fallback is the PAC result returned (with the error) when evaluation fails. Defaults to "DIRECT".
+	Fallback string
+	// PoolSize is the number of initialised engines kept ready for evaluation. Defaults to the number of CPUs.
+	PoolSize int
+	// Engine is the name of the JavaScript engine to use; see Engines. Defaults to DefaultEngine.
+	Engine string
+	// Overlay is JavaScript loaded after the PAC. The PAC's entry points are renamed CorporateFindProxyForURL and
+	// CorporateFindProxyForURLEx so the overlay's FindProxyForURL can call them and adjust the result.
+	Overlay string
+
+	// CacheKey is the granularity results are cached at; CacheKeyHost (default), CacheKeyPath or CacheKeyURL
+	CacheKey string
+	// StripPath replaces the path and query of https:// and wss:// URLs with "/" before evaluation, as browsers do
+	StripPath bool
+	// ResultTTL is how long PAC results are cached. Defaults to DefaultResultTTL.
+	ResultTTL time.Duration
+	// ErrorTTL is how long evaluation errors are cached. Defaults to DefaultErrorTTL; negative disables it.
+	ErrorTTL time.Duration
+	// CacheSize is the maximum number of cached PAC results. Defaults to DefaultCacheSize.
+	CacheSize int
+	// DNSTTL is how long dnsResolve results are cached. Defaults to DefaultDNSTTL.
+	DNSTTL time.Duration
+	// DNSCacheSize is the maximum number of cached dnsResolve results. Defaults to DefaultDNSCacheSize.
+	DNSCacheSize int
+
+	// Resolver is used by dnsResolve and isResolvable. Defaults to the system resolver.
+	Resolver resolver.Resolver
+	// DNSTimeout bounds each lookup made by the PAC. Defaults to DefaultDNSTimeout.
+	DNSTimeout time.Duration
+
+	// MyIPAddress returns the address reported by myIpAddress. Defaults to the source address of the default route.
+	MyIPAddress func() string
+
+	// ScriptLogLimit is the number of alert / console.log messages logged per second. Defaults to
+	// DefaultScriptLogLimit; negative silences them.
+	ScriptLogLimit int
+}
+
+// Stats counts activity in the sandbox caches and engine pool
+type Stats struct {
+	Results CacheStats `json:"results"`
+	DNS     CacheStats `json:"dns"`
+	// IdleEngines is the number of engines waiting in the pool
+	IdleEngines int `json:"idle_engines"`
+}
+
+// cachedResult is a result cache entry; failed evaluations are cached too so a broken PAC is not rerun constantly
+type cachedResult struct {
+	result string
+	err    error
+}
+
 // PacSandbox holds state for the pac sandbox instance
 type PacSandbox struct {
 	pac         string
-	vm          *otto.Otto
-	cache       *ttlcache.Cache // TODO rename
-	resultCache *ttlcache.Cache
+	entryPoint  string
+	opts        Opts
+	engine      Engine
+	pool        chan Engine
+	patterns    *lruCache
+	dnsCache    *lruCache
+	resultCache *lruCache
+	scriptLog   *scriptLogger
 }
 
 // New is the constructor for PacSandbox
-func New(pac string) *PacSandbox {
+// An error is returned if the PAC fails to run or does not define an entry point
+func New(pac string) (*PacSandbox, error) {
+	return NewWithOpts(pac, &Opts{})
+}
+
+// NewWithOpts is the constructor for PacSandbox with non-default options
+func NewWithOpts(pac string, opts *Opts) (*PacSandbox, error) {
 	sandbox := &PacSandbox{
-		pac: pac,
-		vm:  otto.New(),
+		pac:      pac,
+		opts:     *opts,
+		patterns: newLRUCache(patternCacheSize, 0),
+	}
+
+	if sandbox.opts.Timeout <= 0 {
+		sandbox.opts.Timeout = DefaultTimeout
+	}
+
+	if sandbox.opts.Fallback == "" {
+		sandbox.opts.Fallback = "DIRECT"
+	}
+
+	if sandbox.opts.PoolSize <= 0 {
+		sandbox.opts.PoolSize = runtime.NumCPU()
+	}
+
+	if sandbox.opts.Engine == "" {
+		sandbox.opts.Engine = DefaultEngine
+	}
+
+	if sandbox.opts.CacheKey == "" {
+		sandbox.opts.CacheKey = CacheKeyHost
+	}
+
+	if sandbox.opts.CacheKey != CacheKeyHost && sandbox.opts.CacheKey != CacheKeyPath && sandbox.opts.CacheKey != CacheKeyURL {
+		return nil, fmt.Errorf("Unknown cache key '%s'. Valid keys are: %s, %s, %s", sandbox.opts.CacheKey, CacheKeyHost, CacheKeyPath, CacheKeyURL)
+	}
+
+	if sandbox.opts.ResultTTL <= 0 {
+		sandbox.opts.ResultTTL = DefaultResultTTL
+	}
+
+	if sandbox.opts.ErrorTTL == 0 {
+		sandbox.opts.ErrorTTL = DefaultErrorTTL
+	}
+
+	if sandbox.opts.CacheSize <= 0 {
+		sandbox.opts.CacheSize = DefaultCacheSize
+	}
+
+	if sandbox.opts.DNSTTL <= 0 {
+		sandbox.opts.DNSTTL = DefaultDNSTTL
+	}
+
+	if sandbox.opts.DNSCacheSize <= 0 {
+		sandbox.opts.DNSCacheSize = DefaultDNSCacheSize
+	}
+
+	if sandbox.opts.Resolver == nil {
+		sandbox.opts.Resolver = resolver.New()
+	}
+
+	if sandbox.opts.DNSTimeout <= 0 {
+		sandbox.opts.DNSTimeout = DefaultDNSTimeout
+	}
+
+	if sandbox.opts.MyIPAddress == nil {
+		address := SourceAddress(defaultRouteTarget)
+		sandbox.opts.MyIPAddress = func() string { return address }
+	}
+
+	if sandbox.opts.ScriptLogLimit == 0 {
+		sandbox.opts.ScriptLogLimit = DefaultScriptLogLimit
 	}
 
-	sandbox.Reset()
-	sandbox.initPacFunctions()
-	sandbox.vm.Run(pac)
+	sandbox.scriptLog = newScriptLogger(sandbox.opts.ScriptLogLimit)
+	sandbox.resultCache = newLRUCache(sandbox.opts.CacheSize, sandbox.opts.ResultTTL)
+	sandbox.dnsCache = newLRUCache(sandbox.opts.DNSCacheSize, sandbox.opts.DNSTTL)
 
-	return sandbox
+	engine, err := NewEngine(sandbox.opts.Engine)
+	if err != nil {
+		return nil, err
+	}
+	sandbox.engine = engine
+
+	_, err = sandbox.run(engine, func() (string, error) {
+		if err := sandbox.initPacFunctions(); err != nil {
+			return "", err
+		}
+		return "", engine.Load(pac)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Error loading PAC: %s", err)
+	}
+
+	if sandbox.findEntryPoint() == "" {
+		return nil, ErrNoEntryPoint
+	}
+
+	if sandbox.opts.Overlay != "" {
+		_, err = sandbox.run(engine, func() (string, error) {
+			if err := engine.Load(overlayPrelude); err != nil {
+				return "", err
+			}
+			return "", engine.Load(sandbox.opts.Overlay)
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Error loading overlay: %s", err)
+		}
+	}
+
+	sandbox.entryPoint = sandbox.findEntryPoint()
+	if sandbox.entryPoint == "" {
+		return nil, ErrNoEntryPoint
+	}
+
+	// The loaded engine is only ever cloned. Pooled clones are reused between evaluations so, as in a browser,
+	// a PAC that writes to globals will see its own earlier writes.
+	sandbox.pool = make(chan Engine, sandbox.opts.PoolSize)
+	for i := 0; i < sandbox.opts.PoolSize; i++ {
+		clone, err := engine.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading PAC: %s", err)
+		}
+		sandbox.pool <- clone
+	}
+
+	return sandbox, nil
+}
+
+// findEntryPoint returns the name of the function to call for each URL or "" if there isn't one
+// FindProxyForURLEx is the IPv6 aware variant; prefer it where the script provides both
+func (p *PacSandbox) findEntryPoint() string {
+	for _, entryPoint := range []string{"FindProxyForURLEx", "FindProxyForURL"} {
+		if p.engine.Defined(entryPoint) {
+			return entryPoint
+		}
+	}
+
+	return ""
 }
 
 // ProxyFor will take a URL, run it through the PAC logic and produce a PAC result string
+// If evaluation fails or times out the configured fallback is returned along with the error
+// It is safe to call from multiple goroutines; each evaluation has an engine to itself.
 func (p *PacSandbox) ProxyFor(u string) (string, error) {
+	if p.opts.StripPath {
+		u = stripPath(u)
+	}
+
 	parsedURL := earl.Parse(u)
 
-	key := fmt.Sprintf("%s-%s-%s-result", parsedURL.Scheme, parsedURL.Host, parsedURL.Port)
+	key := p.cacheKey(u, parsedURL)
 	if val, ok := p.resultCache.Get(key); ok {
-		log.WithFields(log.Fields{"key": key}).Debug("PacSandbox result cache hit")
-		return val, nil
-	}
+		cached := val.(cachedResult)
+		log.WithFields(log.Fields{"key": key, "error": cached.err}).Debug("PacSandbox result cache hit")
 
-	js := fmt.Sprintf(
-		"FindProxyForURL(%#v, %#v);",
-		u,
-		parsedURL.Host,
-	)
+		if cached.err != nil {
+			return p.opts.Fallback, cached.err
+		}
+		return cached.result, nil
+	}
 
-	vm := p.vm.Copy()
-	result, err := p.ottoRetString(
-		vm.Run(js),
-	)
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), urlKey{}, u), p.opts.Timeout)
+	defer cancel()
 
+	engine, err := p.acquireEngine()
 	if err == nil {
-		p.resultCache.Set(key, result)
+		var result string
+		result, err = p.run(engine, func() (string, error) {
+			return engine.Call(ctx, p.entryPoint, u, parsedURL.Host)
+		})
+
+		if err == nil {
+			p.releaseEngine(engine)
+			p.resultCache.Set(key, cachedResult{result: result})
+
+			log.WithFields(log.Fields{"result": result, "url": u}).Debug("PAC result")
+
+			return result, nil
+		}
 	}
 
-	log.WithFields(log.Fields{"result": result, "url": u}).Debug("PAC result")
+	// An engine that failed may be part way through mutating its globals so a fresh one takes its place
+	if engine != nil {
+		if fresh, cloneErr := p.engine.Clone(); cloneErr == nil {
+			p.releaseEngine(fresh)
+		}
+	}
+
+	if p.opts.ErrorTTL > 0 {
+		p.resultCache.SetWithTTL(key, cachedResult{err: err}, p.opts.ErrorTTL)
+	}
+
+	log.WithFields(log.Fields{"error": err, "fallback": p.opts.Fallback, "url": u}).Debug("PAC evaluation failed")
+	return p.opts.Fallback, err
+}
+
+// Stats returns a snapshot of the cache counters
+func (p *PacSandbox) Stats() Stats {
+	return Stats{
+		Results:     p.resultCache.Stats(),
+		DNS:         p.dnsCache.Stats(),
+		IdleEngines: len(p.pool),
+	}
+}
+
+// cacheKey returns the result cache key for u according to the configured granularity
+func (p *PacSandbox) cacheKey(u string, parsedURL *earl.URL) string {
+	switch p.opts.CacheKey {
+	case CacheKeyURL:
+		return u
+	case CacheKeyPath:
+		if netURL, err := url.Parse(u); err == nil {
+			return fmt.Sprintf("%s-%s-%s", netURL.Scheme, netURL.Host, netURL.Path)
+		}
+		return u
+	}
+
+	return fmt.Sprintf("%s-%s-%s", parsedURL.Scheme, parsedURL.Host, parsedURL.Port)
+}
+
+// stripPath reduces secure URLs to scheme, host and port so the PAC can't see the path or query.
+// Browsers do this to avoid leaking secrets in https URLs to the PAC (and whoever wrote it).
+func stripPath(u string) string {
+	netURL, err := url.Parse(u)
+	if err != nil || (netURL.Scheme != "https" && netURL.Scheme != "wss") {
+		return u
+	}
+
+	return netURL.Scheme + "://" + netURL.Host + "/"
+}
+
+// acquireEngine takes an engine from the pool or makes a new one if all are in use
+func (p *PacSandbox) acquireEngine() (Engine, error) {
+	select {
+	case engine := <-p.pool:
+		return engine, nil
+	default:
+		return p.engine.Clone()
+	}
+}
+
+// releaseEngine returns an engine to the pool, dropping it if the pool is already full
+func (p *PacSandbox) releaseEngine(engine Engine) {
+	select {
+	case p.pool <- engine:
+	default:
+	}
+}
+
+// run invokes fn, interrupting engine after the timeout.
+// Go panics raised by builtins (or by the interrupt) are recovered and returned as errors.
+func (p *PacSandbox) run(engine Engine, fn func() (string, error)) (result string, err error) {
+	timer := time.AfterFunc(p.opts.Timeout, func() {
+		engine.Interrupt(ErrTimeout)
+	})
+
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caughtErr, ok := caught.(error); ok {
+				err = caughtErr
+			} else {
+				err = fmt.Errorf("PAC evaluation panicked: %v", caught)
+			}
+		}
+
+		// If the timer fired the interrupt may still be pending so the engine must not be reused
+		if !timer.Stop() && err == nil {
+			err = ErrTimeout
+		}
+	}()
 
-	return result, err
+	return fn()
 }
 
-// Reset will (re)initialize internal caches
+// Reset will empty the result and DNS caches
 func (p *PacSandbox) Reset() {
-	p.cache = ttlcache.NewCache(5 * time.Minute)
-	p.resultCache = ttlcache.NewCache(30 * time.Second)
+	p.dnsCache.Purge()
+	p.resultCache.Purge()
 }
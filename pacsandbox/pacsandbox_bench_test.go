@@ -0,0 +1,105 @@
+package pacsandbox
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mikesimons/earl"
+)
+
+const benchmarkPac = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".internal.corp")) {
+		return "DIRECT";
+	}
+
+	if (shExpMatch(host, "*.partner.example") || shExpMatch(url, "http://*/downloads/*")) {
+		return "PROXY partner.proxy:8080";
+	}
+
+	if (isInNet(host, "10.0.0.0", "255.0.0.0") || isInNet(host, "192.168.0.0", "255.255.0.0")) {
+		return "DIRECT";
+	}
+
+	return "PROXY proxy.corp:8080; DIRECT";
+}
+`
+
+func newBenchmarkSandbox(b *testing.B, engine string) *PacSandbox {
+	sandbox, err := NewWithOpts(benchmarkPac, &Opts{Engine: engine})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return sandbox
+}
+
+// benchmarkURL returns a distinct URL per iteration so every evaluation misses the result cache
+func benchmarkURL(i int) string {
+	return fmt.Sprintf("http://host%d.example.com/path", i)
+}
+
+// BenchmarkProxyForUnpooled measures the original evaluation path: a full VM copy and a generated script per call
+func BenchmarkProxyForUnpooled(b *testing.B) {
+	sandbox := newBenchmarkSandbox(b, "otto")
+	vm := sandbox.engine.(*ottoEngine).vm
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		u := benchmarkURL(i)
+		js := fmt.Sprintf("%s(%#v, %#v);", sandbox.entryPoint, u, earl.Parse(u).Host)
+		if _, err := vm.Copy().Run(js); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProxyFor(b *testing.B) {
+	sandbox := newBenchmarkSandbox(b, "otto")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := sandbox.ProxyFor(benchmarkURL(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProxyForGoja(b *testing.B) {
+	sandbox := newBenchmarkSandbox(b, "goja")
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := sandbox.ProxyFor(benchmarkURL(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProxyForParallel(b *testing.B) {
+	sandbox := newBenchmarkSandbox(b, DefaultEngine)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			if _, err := sandbox.ProxyFor(benchmarkURL(i) + fmt.Sprintf("%p", pb)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkShExpMatch(b *testing.B) {
+	sandbox := newBenchmarkSandbox(b, DefaultEngine)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sandbox.shExpMatch("www.partner.example", "*.partner.example")
+	}
+}
@@ -2,129 +2,468 @@ package pacsandbox_test
 
 import (
 	. "github.com/mikesimons/pacyak/pacsandbox"
+	"github.com/mikesimons/pacyak/resolver"
+
+	log "github.com/Sirupsen/logrus"
+
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("PacSandbox", func() {
-	Describe("New", func() {
-		It("should create a new instance of PacSandbox", func() {
-			it := New("")
-			Expect(it).Should(BeAssignableToTypeOf(&PacSandbox{}))
-		})
+	Describe("NewEngine", func() {
+		It("should return an error for an unknown engine", func() {
+			_, err := NewEngine("spidermonkey")
+			Expect(err).Should(HaveOccurred())
 
-		// should do what if FindProxyForURL not defined?
-		// should do what on syntax error?
+			_, err = NewWithOpts(`function FindProxyForURL(url, host) { return "DIRECT"; }`, &Opts{Engine: "spidermonkey"})
+			Expect(err).Should(HaveOccurred())
+		})
 	})
 
-	Describe("ProxyFor", func() {
-		It("should return a proxy for a url", func() {
-			it := New(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
-			Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+	Describe("SourceAddress", func() {
+		It("should return the address used to reach the host", func() {
+			Expect(SourceAddress("127.0.0.1")).Should(Equal("127.0.0.1"))
+			Expect(SourceAddress("127.0.0.1:8080")).Should(Equal("127.0.0.1"))
 		})
+	})
 
-		It("should use PAC to return correct proxy", func() {
-			it := New(`
-			function FindProxyForURL(url, host) {
-				if(host == "google.com") {
-					return "DIRECT";
-				} else {
-					return "PROXY hp.com";
-				}
-			}`)
-			Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
-			Expect(it.ProxyFor("http://hp.com")).Should(Equal("PROXY hp.com"))
-		})
+	// Lookups go to a fake resolver so the suite doesn't depend on the network
+	hosts := resolver.Static{
+		"google-public-dns-a.google.com": {"2001:4860:4860::8888", "8.8.8.8"},
+		"google.com":                     {"216.58.204.46"},
+		"ipv6.google.com":                {"2a00:1450:4009:80f::200e"},
+	}
 
-		// should do what for invalid url?
+	// Every engine must pass the same PAC conformance suite
+	for _, engine := range Engines() {
+		engine := engine
 
-		Describe("dnsResolve", func() {
-			It("should resolve a hostname to an IP", func() {
-				it := New(`function FindProxyForURL(url, host) { return dnsResolve(host); }`)
-				Expect(it.ProxyFor("http://google-public-dns-a.google.com")).Should(Equal("8.8.8.8"))
-			})
+		newSandbox := func(pac string) (*PacSandbox, error) {
+			return NewWithOpts(pac, &Opts{Engine: engine, Resolver: hosts})
+		}
 
-			It("should panic for invalid hostname", func() {
-				it := New(`function FindProxyForURL(url, host) { return dnsResolve(host); }`)
-				Expect(func() { it.ProxyFor("http://blah.blah.gobble") }).Should(Panic())
-			})
+		newSandboxWithOpts := func(pac string, opts *Opts) (*PacSandbox, error) {
+			opts.Engine = engine
+			if opts.Resolver == nil {
+				opts.Resolver = hosts
+			}
+			return NewWithOpts(pac, opts)
+		}
 
-			// should do what if not passed anything?
-		})
+		Describe("with "+engine+" engine", func() {
+			Describe("New", func() {
+				It("should create a new instance of PacSandbox", func() {
+					it, err := newSandbox(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(it).Should(BeAssignableToTypeOf(&PacSandbox{}))
+				})
 
-		Describe("dnsDomainIs", func() {
-			It("should return boolean indicating if host is subdomain", func() {
-				it := New(`function FindProxyForURL(url, host) { return dnsDomainIs(host, "google.com"); }`)
-				Expect(it.ProxyFor("http://google.com")).Should(Equal("true"))
-				Expect(it.ProxyFor("http://hp.com")).Should(Equal("false"))
-			})
+				It("should return an error if FindProxyForURL is not defined", func() {
+					_, err := newSandbox("")
+					Expect(err).Should(Equal(ErrNoEntryPoint))
 
-			It("should panic with anything less than 2 args", func() {
-				it := New(`function FindProxyForURL(url, host) { return dnsDomainIs(); }`)
-				Expect(func() { it.ProxyFor("http://google.com") }).Should(Panic())
+					_, err = newSandbox(`var FindProxyForURL = "DIRECT";`)
+					Expect(err).Should(Equal(ErrNoEntryPoint))
+				})
 
-				it = New(`function FindProxyForURL(url, host) { return dnsDomainIs(1); }`)
-				Expect(func() { it.ProxyFor("http://google.com") }).Should(Panic())
-			})
-		})
+				It("should return an error on syntax error", func() {
+					_, err := newSandbox(`function FindProxyForURL(url, host) { return "DIRECT"; `)
+					Expect(err).Should(HaveOccurred())
+				})
 
-		Describe("isResolvable", func() {
-			It("should return boolean indicating if host is resolvable", func() {
-				it := New(`function FindProxyForURL(url, host) { return isResolvable(host); }`)
-				Expect(it.ProxyFor("http://google.com")).Should(Equal("true"))
-				Expect(it.ProxyFor("http://blah.blah.gobble")).Should(Equal("false"))
-			})
-		})
+				It("should return an error if the PAC throws while loading", func() {
+					_, err := newSandbox(`throw "broken"; function FindProxyForURL(url, host) { return "DIRECT"; }`)
+					Expect(err).Should(HaveOccurred())
+				})
 
-		Describe("shExpMatch", func() {
-			It("should return boolean indicating if expression matches", func() {
-				it := New(`function FindProxyForURL(url, host) { return shExpMatch(url, "*google.com*"); }`)
-				Expect(it.ProxyFor("http://google.com/test")).Should(Equal("true"))
-				Expect(it.ProxyFor("google.com/test")).Should(Equal("true"))
-				Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
-
-				it = New(`function FindProxyForURL(url, host) { return shExpMatch(url, "*google.com"); }`)
-				Expect(it.ProxyFor("http://google.com/test")).Should(Equal("false"))
-				Expect(it.ProxyFor("google.com")).Should(Equal("true"))
-				Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
-
-				it = New(`function FindProxyForURL(url, host) { return shExpMatch(url, "*goo?le.com*"); }`)
-				Expect(it.ProxyFor("http://google.com/test")).Should(Equal("true"))
-				Expect(it.ProxyFor("goodle.com")).Should(Equal("true"))
-				Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
+				It("should accept FindProxyForURLEx", func() {
+					it, err := newSandbox(`function FindProxyForURLEx(url, host) { return "PROXY ex.proxy:8080"; }`)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(it.ProxyFor("http://google.com")).Should(Equal("PROXY ex.proxy:8080"))
+				})
 			})
-		})
 
-		Describe("isInNet", func() {
-			It("should return boolean indicating if ip is in range", func() {
-				it := New(`function FindProxyForURL(url, host) { return isInNet(url, "127.0.0.0", "255.255.255.0"); }`)
-				Expect(it.ProxyFor("127.0.0.1")).Should(Equal("true"))
-				Expect(it.ProxyFor("127.0.77.1")).Should(Equal("false"))
-				Expect(it.ProxyFor("192.0.0.1")).Should(Equal("false"))
-
-				it = New(`function FindProxyForURL(url, host) { return isInNet(url, "127.0.0.0", "255.255.0.0"); }`)
-				Expect(it.ProxyFor("127.0.0.1")).Should(Equal("true"))
-				Expect(it.ProxyFor("127.0.77.1")).Should(Equal("true"))
-				Expect(it.ProxyFor("192.0.0.1")).Should(Equal("false"))
+			Describe("Overlay", func() {
+				corporate := `function FindProxyForURL(url, host) { return "PROXY corp.proxy:8080"; }`
+
+				It("should let the overlay wrap the corporate PAC", func() {
+					it, err := newSandboxWithOpts(corporate, &Opts{Overlay: `
+						function FindProxyForURL(url, host) {
+							if (host == "staging.corp") { return "DIRECT"; }
+							return CorporateFindProxyForURL(url, host) + "; DIRECT";
+						}
+					`})
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(it.ProxyFor("http://staging.corp")).Should(Equal("DIRECT"))
+					Expect(it.ProxyFor("http://google.com")).Should(Equal("PROXY corp.proxy:8080; DIRECT"))
+				})
+
+				It("should use the overlay entry point over a corporate FindProxyForURLEx", func() {
+					it, _ := newSandboxWithOpts(`function FindProxyForURLEx(url, host) { return "PROXY ex.proxy:8080"; }`, &Opts{Overlay: `
+						function FindProxyForURL(url, host) { return "overlay " + CorporateFindProxyForURLEx(url, host); }
+					`})
+					Expect(it.ProxyFor("http://google.com")).Should(Equal("overlay PROXY ex.proxy:8080"))
+				})
+
+				It("should return an error if the overlay fails to load or defines no entry point", func() {
+					_, err := newSandboxWithOpts(corporate, &Opts{Overlay: `function FindProxyForURL(url, host) {`})
+					Expect(err).Should(HaveOccurred())
+
+					_, err = newSandboxWithOpts(corporate, &Opts{Overlay: `var x = 1;`})
+					Expect(err).Should(Equal(ErrNoEntryPoint))
+				})
 			})
-		})
 
-		Describe("isPlainHostName", func() {
-			It("should return boolean indicating if hostname is plain", func() {
-				it := New(`function FindProxyForURL(url, host) { return isPlainHostName(host); }`)
-				Expect(it.ProxyFor("http://google.com")).Should(Equal("false"))
-				Expect(it.ProxyFor("http://localhost")).Should(Equal("true"))
-				Expect(it.ProxyFor("http://cheesesticks")).Should(Equal("true"))
+			Describe("ProxyFor", func() {
+				It("should return a proxy for a url", func() {
+					it, _ := newSandbox(`function FindProxyForURL(url, host) { return "DIRECT"; }`)
+					Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+				})
+
+				It("should use PAC to return correct proxy", func() {
+					it, _ := newSandbox(`
+					function FindProxyForURL(url, host) {
+						if(host == "google.com") {
+							return "DIRECT";
+						} else {
+							return "PROXY hp.com";
+						}
+					}`)
+					Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+					Expect(it.ProxyFor("http://hp.com")).Should(Equal("PROXY hp.com"))
+				})
+
+				// should do what for invalid url?
+
+				It("should be safe for concurrent use", func() {
+					it, _ := newSandboxWithOpts(`
+					var calls = 0;
+					function FindProxyForURL(url, host) {
+						calls++;
+						return shExpMatch(host, "*.corp") ? "PROXY corp.proxy:8080" : "DIRECT";
+					}`, &Opts{PoolSize: 2})
+
+					var wg sync.WaitGroup
+					for i := 0; i < 20; i++ {
+						wg.Add(1)
+						go func(i int) {
+							defer GinkgoRecover()
+							defer wg.Done()
+							Expect(it.ProxyFor(fmt.Sprintf("http://host%d.corp", i))).Should(Equal("PROXY corp.proxy:8080"))
+							Expect(it.ProxyFor(fmt.Sprintf("http://host%d.com", i))).Should(Equal("DIRECT"))
+						}(i)
+					}
+					wg.Wait()
+				})
+
+				It("should time out a PAC that never returns", func() {
+					it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { while(true) {} }`, &Opts{Timeout: 100 * time.Millisecond})
+					result, err := it.ProxyFor("http://google.com")
+					Expect(err).Should(Equal(ErrTimeout))
+					Expect(result).Should(Equal("DIRECT"))
+				})
+
+				It("should time out engines whose scripts never finish loading again", func() {
+					var loads int32
+					it, err := newSandboxWithOpts(`
+					if (myIpAddress() != "10.0.0.1") { while(true) {} }
+					function FindProxyForURL(url, host) { return "PROXY corp.proxy:8080"; }`, &Opts{
+						Timeout:  100 * time.Millisecond,
+						PoolSize: 1,
+						MyIPAddress: func() string {
+							if atomic.AddInt32(&loads, 1) == 1 {
+								return "10.0.0.1"
+							}
+							return "10.0.0.2"
+						},
+					})
+					Expect(err).ShouldNot(HaveOccurred())
+
+					done := make(chan string)
+					go func() {
+						result, _ := it.ProxyFor("http://google.com")
+						done <- result
+					}()
+
+					// Engines that copy their state don't run the script again and go on using it
+					Eventually(done, "2s").Should(Receive(Or(Equal("DIRECT"), Equal("PROXY corp.proxy:8080"))))
+				})
+
+				It("should keep the engine pool full when evaluations fail", func() {
+					it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) {
+						if (host == "bad.corp") throw "nope";
+						return "DIRECT";
+					}`, &Opts{PoolSize: 2})
+
+					for i := 0; i < 3; i++ {
+						_, err := it.ProxyFor(fmt.Sprintf("http://bad.corp:%d", 8000+i))
+						Expect(err).Should(HaveOccurred())
+					}
+
+					Expect(it.Stats().IdleEngines).Should(Equal(2))
+					Expect(it.ProxyFor("http://good.corp")).Should(Equal("DIRECT"))
+				})
+
+				It("should return the configured fallback on error", func() {
+					it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { throw "nope"; }`, &Opts{Fallback: "PROXY fallback.proxy:8080"})
+					result, err := it.ProxyFor("http://google.com")
+					Expect(err).Should(HaveOccurred())
+					Expect(result).Should(Equal("PROXY fallback.proxy:8080"))
+				})
+
+				Describe("caching", func() {
+					pathPac := `function FindProxyForURL(url, host) { return shExpMatch(url, "*/api/*") ? "PROXY api.proxy:8080" : "DIRECT"; }`
+
+					It("should cache results per host by default", func() {
+						it, _ := newSandbox(pathPac)
+						Expect(it.ProxyFor("http://example.com/api/thing")).Should(Equal("PROXY api.proxy:8080"))
+						Expect(it.ProxyFor("http://example.com/other")).Should(Equal("PROXY api.proxy:8080"))
+						Expect(it.Stats().Results.Hits).Should(Equal(uint64(1)))
+					})
+
+					It("should cache results per path if configured", func() {
+						it, _ := newSandboxWithOpts(pathPac, &Opts{CacheKey: CacheKeyPath})
+						Expect(it.ProxyFor("http://example.com/api/thing")).Should(Equal("PROXY api.proxy:8080"))
+						Expect(it.ProxyFor("http://example.com/other")).Should(Equal("DIRECT"))
+						Expect(it.ProxyFor("http://example.com/other?query=1")).Should(Equal("DIRECT"))
+						Expect(it.Stats().Results.Hits).Should(Equal(uint64(1)))
+					})
+
+					It("should reject an unknown cache key", func() {
+						_, err := newSandboxWithOpts(pathPac, &Opts{CacheKey: "fragment"})
+						Expect(err).Should(HaveOccurred())
+					})
+
+					It("should strip the path and query of secure URLs if configured", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { return url; }`, &Opts{StripPath: true, CacheKey: CacheKeyURL})
+						Expect(it.ProxyFor("https://example.com/secret/token?key=1")).Should(Equal("https://example.com/"))
+						Expect(it.ProxyFor("http://example.com/path?key=1")).Should(Equal("http://example.com/path?key=1"))
+					})
+
+					It("should cache errors briefly", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { throw "nope"; }`, &Opts{ErrorTTL: 50 * time.Millisecond})
+						_, err := it.ProxyFor("http://example.com")
+						Expect(err).Should(HaveOccurred())
+						_, err = it.ProxyFor("http://example.com")
+						Expect(err).Should(HaveOccurred())
+						Expect(it.Stats().Results.Hits).Should(Equal(uint64(1)))
+
+						time.Sleep(100 * time.Millisecond)
+						it.ProxyFor("http://example.com")
+						Expect(it.Stats().Results.Expirations).Should(Equal(uint64(1)))
+					})
+
+					It("should evict the least recently used result when full", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { return "DIRECT"; }`, &Opts{CacheSize: 1})
+						it.ProxyFor("http://one.example.com")
+						it.ProxyFor("http://two.example.com")
+						Expect(it.Stats().Results.Evictions).Should(Equal(uint64(1)))
+						Expect(it.Stats().Results.Entries).Should(Equal(1))
+					})
+				})
+
+				Describe("dnsResolve", func() {
+					It("should resolve a hostname to an IP", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return dnsResolve(host); }`)
+						Expect(it.ProxyFor("http://google-public-dns-a.google.com")).Should(Equal("8.8.8.8"))
+					})
+
+					It("should prefer IPv4 addresses but return IPv6 if that is all there is", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return dnsResolve(host); }`)
+						Expect(it.ProxyFor("http://ipv6.google.com")).Should(Equal("2a00:1450:4009:80f::200e"))
+					})
+
+					It("should not panic for invalid hostname", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return dnsResolve(host); }`)
+						Expect(func() { it.ProxyFor("http://blah.blah.gobble") }).ShouldNot(Panic())
+						Expect(it.ProxyFor("http://blah.blah.gobble")).Should(Equal("false"))
+					})
+
+					It("should give up on slow lookups after the DNS timeout", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { return dnsResolve(host); }`, &Opts{
+							Resolver:   slowResolver{},
+							DNSTimeout: 50 * time.Millisecond,
+						})
+						Expect(it.ProxyFor("http://slow.host")).Should(Equal("false"))
+					})
+
+					It("should time out the evaluation if lookups outlast it", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { return dnsResolve(host); }`, &Opts{
+							Resolver:   slowResolver{},
+							Timeout:    50 * time.Millisecond,
+							DNSTimeout: time.Minute,
+						})
+						_, err := it.ProxyFor("http://slow.host")
+						Expect(err).Should(HaveOccurred())
+					})
+
+					// should do what if not passed anything?
+				})
+
+				Describe("myIpAddress", func() {
+					It("should return the configured address", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { return isInNet(myIpAddress(), "10.0.0.0", "255.0.0.0") ? "PROXY corp.proxy:8080" : "DIRECT"; }`, &Opts{
+							MyIPAddress: func() string { return "10.1.2.3" },
+						})
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("PROXY corp.proxy:8080"))
+					})
+
+					It("should default to an address of this machine", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return myIpAddress(); }`)
+						result, err := it.ProxyFor("http://google.com")
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(net.ParseIP(result)).ShouldNot(BeNil())
+					})
+				})
+
+				Describe("alert", func() {
+					var hook *captureHook
+
+					BeforeEach(func() {
+						hook = &captureHook{}
+						log.AddHook(hook)
+					})
+
+					AfterEach(func() {
+						log.StandardLogger().Hooks = make(log.LevelHooks)
+					})
+
+					It("should log the message with the URL being evaluated", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { alert("routing " + host); return "DIRECT"; }`)
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+						Expect(hook.messages()).Should(Equal([]string{"routing google.com"}))
+						Expect(hook.entries[0].Data["url"]).Should(Equal("http://google.com"))
+					})
+
+					It("should support console.log", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { console.log("routing", host); return "DIRECT"; }`)
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+						Expect(hook.messages()).Should(Equal([]string{"routing google.com"}))
+					})
+
+					It("should rate limit messages", func() {
+						it, _ := newSandboxWithOpts(`function FindProxyForURL(url, host) { for (var i = 0; i < 10; i++) { alert(i); } return "DIRECT"; }`, &Opts{ScriptLogLimit: 3})
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("DIRECT"))
+						Expect(hook.messages()).Should(Equal([]string{"0", "1", "2"}))
+					})
+				})
+
+				Describe("dnsDomainIs", func() {
+					It("should return boolean indicating if host is subdomain", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return dnsDomainIs(host, "google.com"); }`)
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("true"))
+						Expect(it.ProxyFor("http://hp.com")).Should(Equal("false"))
+					})
+
+					It("should return an error with anything less than 2 args", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return dnsDomainIs(); }`)
+						_, err := it.ProxyFor("http://google.com")
+						Expect(err).Should(BeAssignableToTypeOf(&NotEnoughArgumentsError{}))
+
+						it, _ = newSandbox(`function FindProxyForURL(url, host) { return dnsDomainIs(1); }`)
+						_, err = it.ProxyFor("http://google.com")
+						Expect(err).Should(BeAssignableToTypeOf(&NotEnoughArgumentsError{}))
+					})
+				})
+
+				Describe("isResolvable", func() {
+					It("should return boolean indicating if host is resolvable", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return isResolvable(host); }`)
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("true"))
+						Expect(it.ProxyFor("http://blah.blah.gobble")).Should(Equal("false"))
+					})
+				})
+
+				Describe("shExpMatch", func() {
+					It("should return boolean indicating if expression matches", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return shExpMatch(url, "*google.com*"); }`)
+						Expect(it.ProxyFor("http://google.com/test")).Should(Equal("true"))
+						Expect(it.ProxyFor("google.com/test")).Should(Equal("true"))
+						Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
+
+						it, _ = newSandbox(`function FindProxyForURL(url, host) { return shExpMatch(url, "*google.com"); }`)
+						Expect(it.ProxyFor("http://google.com/test")).Should(Equal("false"))
+						Expect(it.ProxyFor("google.com")).Should(Equal("true"))
+						Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
+
+						it, _ = newSandbox(`function FindProxyForURL(url, host) { return shExpMatch(url, "*goo?le.com*"); }`)
+						Expect(it.ProxyFor("http://google.com/test")).Should(Equal("true"))
+						Expect(it.ProxyFor("goodle.com")).Should(Equal("true"))
+						Expect(it.ProxyFor("goggles.com")).Should(Equal("false"))
+					})
+				})
+
+				Describe("isInNet", func() {
+					It("should return boolean indicating if ip is in range", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return isInNet(url, "127.0.0.0", "255.255.255.0"); }`)
+						Expect(it.ProxyFor("127.0.0.1")).Should(Equal("true"))
+						Expect(it.ProxyFor("127.0.77.1")).Should(Equal("false"))
+						Expect(it.ProxyFor("192.0.0.1")).Should(Equal("false"))
+
+						it, _ = newSandbox(`function FindProxyForURL(url, host) { return isInNet(url, "127.0.0.0", "255.255.0.0"); }`)
+						Expect(it.ProxyFor("127.0.0.1")).Should(Equal("true"))
+						Expect(it.ProxyFor("127.0.77.1")).Should(Equal("true"))
+						Expect(it.ProxyFor("192.0.0.1")).Should(Equal("false"))
+					})
+				})
+
+				Describe("isPlainHostName", func() {
+					It("should return boolean indicating if hostname is plain", func() {
+						it, _ := newSandbox(`function FindProxyForURL(url, host) { return isPlainHostName(host); }`)
+						Expect(it.ProxyFor("http://google.com")).Should(Equal("false"))
+						Expect(it.ProxyFor("http://localhost")).Should(Equal("true"))
+						Expect(it.ProxyFor("http://cheesesticks")).Should(Equal("true"))
+					})
+				})
+
+				//PIt("should provide localHostOrDomainIs")
+				//PIt("should provide dnsDomainLevels")
+				//PIt("should provide weekdayRange")
+				//PIt("should provide dateRange")
+				//PIt("should provide timeRange")
 			})
 		})
-
-		//PIt("should provide myIpAddress")
-		//PIt("should provide localHostOrDomainIs")
-		//PIt("should provide dnsDomainLevels")
-		//PIt("should provide weekdayRange")
-		//PIt("should provide dateRange")
-		//PIt("should provide timeRange")
-		//PIt("should provide alert")
-	})
+	}
 })
+
+// slowResolver never answers; lookups end when the context does
+type slowResolver struct{}
+
+func (slowResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// captureHook records info level log entries
+type captureHook struct {
+	entries []*log.Entry
+	lock    sync.Mutex
+}
+
+func (h *captureHook) Levels() []log.Level { return []log.Level{log.InfoLevel} }
+
+func (h *captureHook) Fire(entry *log.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func (h *captureHook) messages() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var messages []string
+	for _, entry := range h.entries {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
@@ -0,0 +1,68 @@
+package pacsandbox
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultScriptLogLimit is the number of alert / console.log messages logged per second if Opts.ScriptLogLimit is not set
+const DefaultScriptLogLimit = 10
+
+// consoleShim routes console.log (and friends) through the alert builtin's logging
+const consoleShim = `var console = (function() {
+	function log() { __pacyakLog(Array.prototype.join.call(arguments, " ")); }
+	return { log: log, info: log, warn: log, error: log, debug: log };
+})();`
+
+// urlKey is the context key holding the URL being evaluated
+type urlKey struct{}
+
+// scriptLogger logs messages from PAC scripts, dropping any beyond limit per second.
+// PAC files commonly alert on every call so without a limit a busy proxy would drown the log.
+type scriptLogger struct {
+	limit      int
+	window     time.Time
+	count      int
+	suppressed int
+	lock       sync.Mutex
+}
+
+func newScriptLogger(limit int) *scriptLogger {
+	return &scriptLogger{limit: limit}
+}
+
+// Log writes a script message tagged with the URL under evaluation, if the rate limit allows
+func (l *scriptLogger) Log(ctx context.Context, function string, args []string) {
+	if l.limit < 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if now.Sub(l.window) >= time.Second {
+		if l.suppressed > 0 {
+			log.WithFields(log.Fields{"suppressed": l.suppressed}).Warn("PAC script messages were rate limited")
+		}
+		l.window = now
+		l.count = 0
+		l.suppressed = 0
+	}
+
+	l.count++
+	allowed := l.count <= l.limit
+	if !allowed {
+		l.suppressed++
+	}
+	l.lock.Unlock()
+
+	if !allowed {
+		return
+	}
+
+	url, _ := ctx.Value(urlKey{}).(string)
+	log.WithFields(log.Fields{"url": url, "function": function}).Info(strings.Join(args, " "))
+}
@@ -0,0 +1,194 @@
+/*
+Package pactransport lets Go HTTP clients follow PAC routing decisions without running the pacyak daemon.
+
+	sandbox, err := pacsandbox.New(pac)
+	transport := pactransport.New(sandbox)
+	defer transport.Close()
+	client := &http.Client{Transport: transport.HTTPTransport()}
+
+Requests whose PAC result starts with an available PROXY are sent to that proxy by http.Transport.
+DIRECT and SOCKS results (and PROXY results when no proxy is available) are handled by DialContext,
+which works through the PAC list in order until a connection succeeds or it reaches BLOCK.
+*/
+package pactransport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mikesimons/pacyak/proxyfactory"
+)
+
+// Interpreter produces a PAC result string for a URL; *pacsandbox.PacSandbox satisfies it
+type Interpreter interface {
+	ProxyFor(string) (string, error)
+}
+
+// Transport holds state for routing client connections according to a PAC file
+type Transport struct {
+	Sandbox Interpreter
+	Factory *proxyfactory.ProxyFactory
+	Dialer  *net.Dialer
+
+	proxyAddrs map[string]bool
+	lock       sync.Mutex
+}
+
+// New is the constructor for Transport
+func New(sandbox Interpreter) *Transport {
+	return &Transport{
+		Sandbox: sandbox,
+		Factory: proxyfactory.New(),
+		Dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		proxyAddrs: make(map[string]bool),
+	}
+}
+
+// Close stops the availability checks of the transport's proxy factory. The transport must not be used afterwards.
+func (t *Transport) Close() {
+	t.Factory.Close()
+}
+
+// HTTPTransport returns an http.Transport using Proxy and DialContext
+func (t *Transport) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 t.Proxy,
+		DialContext:           t.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+// Proxy is suitable for http.Transport.Proxy.
+// It returns the URL of the first available HTTP proxy in the PAC result or nil if the first usable entry
+// is DIRECT or SOCKS, leaving those to DialContext.
+func (t *Transport) Proxy(req *http.Request) (*url.URL, error) {
+	entries, err := t.entries(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Type != "PROXY" && entry.Type != "HTTP" {
+			return nil, nil
+		}
+
+		handle := entry.Handle()
+		proxy := t.Factory.Proxy(handle)
+		if !t.Factory.Available(handle) {
+			continue
+		}
+
+		proxyURL, err := proxy.Tr.Proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+
+		t.lock.Lock()
+		t.proxyAddrs[proxyURL.Host] = true
+		t.lock.Unlock()
+
+		return proxyURL, nil
+	}
+
+	return nil, nil
+}
+
+// DialContext is suitable for http.Transport.DialContext.
+// Connections to proxies returned by Proxy are dialed directly. Any other address is run through the PAC
+// and each entry is tried in turn: DIRECT dials the address, SOCKS and PROXY tunnel to it and BLOCK fails the dial.
+func (t *Transport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	t.lock.Lock()
+	isProxy := t.proxyAddrs[addr]
+	t.lock.Unlock()
+
+	if isProxy {
+		return t.Dialer.DialContext(ctx, network, addr)
+	}
+
+	entries, err := t.entries(urlForAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return t.Dialer.DialContext(ctx, network, addr)
+	}
+
+	for _, entry := range entries {
+		if entry.Type == "BLOCK" {
+			return nil, blockedError(addr, entry)
+		}
+
+		var conn net.Conn
+		if entry.Type == "DIRECT" {
+			conn, err = t.Dialer.DialContext(ctx, network, addr)
+		} else {
+			conn, err = t.Factory.Proxy(entry.Handle()).ConnectDial(ctx, network, addr)
+		}
+
+		if err == nil {
+			return conn, nil
+		}
+
+		log.WithFields(log.Fields{"route": entry.Type + " " + entry.Host, "addr": addr, "error": err}).Debug("PAC route failed; trying next")
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("All PAC routes to %s failed; last error: %s", addr, err)
+}
+
+// blockedError describes a dial refused by a BLOCK entry
+func blockedError(addr string, entry proxyfactory.PacEntry) error {
+	if entry.Host == "" {
+		return fmt.Errorf("PAC blocked %s", addr)
+	}
+	return fmt.Errorf("PAC blocked %s: %s", addr, entry.Host)
+}
+
+// entries evaluates the PAC for the given URL
+func (t *Transport) entries(u string) ([]proxyfactory.PacEntry, error) {
+	response, err := t.Sandbox.ProxyFor(u)
+	if err != nil {
+		return nil, fmt.Errorf("PAC evaluation failed for %s: %s", u, err)
+	}
+
+	return proxyfactory.ParsePacResponse(response), nil
+}
+
+// urlForAddr makes a URL for PAC evaluation from a dial address.
+// Only the host and port are known at dial time so we assume https for 443 and http otherwise.
+func urlForAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port == "443" {
+		return "https://" + host
+	}
+
+	if port == "80" {
+		return "http://" + host
+	}
+
+	return "http://" + host + ":" + port
+}
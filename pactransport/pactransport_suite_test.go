@@ -0,0 +1,13 @@
+package pactransport_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPactransport(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pactransport Suite")
+}
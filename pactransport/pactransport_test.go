@@ -0,0 +1,97 @@
+package pactransport_test
+
+import (
+	. "github.com/mikesimons/pacyak/pactransport"
+
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type staticPac string
+
+func (p staticPac) ProxyFor(string) (string, error) { return string(p), nil }
+
+var _ = Describe("Pactransport", func() {
+	Describe("Close", func() {
+		It("should stop the transport's background work", func() {
+			before := runtime.NumGoroutine()
+
+			for i := 0; i < 20; i++ {
+				New(staticPac("DIRECT")).Close()
+			}
+
+			Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", before))
+		})
+	})
+
+	Describe("Proxy", func() {
+		It("should return nil for DIRECT", func() {
+			it := New(staticPac("DIRECT"))
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			Expect(it.Proxy(req)).Should(BeNil())
+		})
+
+		It("should leave SOCKS entries to DialContext", func() {
+			it := New(staticPac("SOCKS5 127.0.0.1:1080"))
+			req, _ := http.NewRequest("GET", "http://example.com", nil)
+			Expect(it.Proxy(req)).Should(BeNil())
+		})
+	})
+
+	Describe("DialContext", func() {
+		It("should dial DIRECT entries", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: New(staticPac("DIRECT")).HTTPTransport()}
+			response, err := client.Get(server.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+			body, _ := ioutil.ReadAll(response.Body)
+			Expect(string(body)).Should(Equal("hello"))
+		})
+
+		It("should fall back through the PAC list", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+
+			it := New(staticPac("SOCKS5 127.0.0.1:1; DIRECT"))
+			conn, err := it.DialContext(context.Background(), "tcp", u.Host)
+			Expect(err).ShouldNot(HaveOccurred())
+			conn.Close()
+		})
+
+		It("should refuse to dial when the PAC result is BLOCK", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+
+			_, err := New(staticPac("BLOCK telemetry")).DialContext(context.Background(), "tcp", u.Host)
+			Expect(err).Should(MatchError(ContainSubstring("telemetry")))
+		})
+
+		It("should stop falling back at BLOCK", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+
+			_, err := New(staticPac("SOCKS5 127.0.0.1:1; BLOCK; DIRECT")).DialContext(context.Background(), "tcp", u.Host)
+			Expect(err).Should(MatchError(ContainSubstring("blocked")))
+		})
+
+		It("should fail when every route fails", func() {
+			it := New(staticPac("SOCKS5 127.0.0.1:1"))
+			_, err := it.DialContext(context.Background(), "tcp", "127.0.0.1:2")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
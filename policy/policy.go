@@ -0,0 +1,105 @@
+/*
+Package policy decides which destinations pacyak will proxy to at all, whatever the rules and PAC say.
+
+Destinations are host name globs or CIDRs. CIDRs only match destinations given as IP addresses; host names are
+not resolved, so deny the names of internal services as well as their networks.
+*/
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mikesimons/pacyak/rules"
+)
+
+// Policy is the destination policy as it appears in the config file
+type Policy struct {
+	// Allow, if set, lists the only destinations that may be reached
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists destinations that may not be reached. It is checked before Allow.
+	Deny []string `json:"deny,omitempty"`
+	// ConnectPorts, if set, lists the only ports CONNECT tunnels may be made to
+	ConnectPorts []int `json:"connect_ports,omitempty"`
+}
+
+// DeniedError is returned by Check for requests the policy refuses
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
+// Enforcer is a compiled Policy. A nil Enforcer allows everything.
+type Enforcer struct {
+	allow        *rules.Rules
+	deny         *rules.Rules
+	connectPorts map[int]bool
+}
+
+// Compile validates and prepares a policy
+func Compile(p Policy) (*Enforcer, error) {
+	var err error
+	enforcer := &Enforcer{}
+
+	if enforcer.allow, err = compileDestinations(p.Allow); err != nil {
+		return nil, fmt.Errorf("Invalid policy allow list: %s", err)
+	}
+
+	if enforcer.deny, err = compileDestinations(p.Deny); err != nil {
+		return nil, fmt.Errorf("Invalid policy deny list: %s", err)
+	}
+
+	if len(p.ConnectPorts) > 0 {
+		enforcer.connectPorts = make(map[int]bool)
+		for _, port := range p.ConnectPorts {
+			enforcer.connectPorts[port] = true
+		}
+	}
+
+	return enforcer, nil
+}
+
+// Check returns a *DeniedError if the policy does not allow a request with method to host:port
+func (e *Enforcer) Check(method string, host string, port int) error {
+	if e == nil {
+		return nil
+	}
+
+	if method == "CONNECT" && e.connectPorts != nil && !e.connectPorts[port] {
+		return &DeniedError{Reason: fmt.Sprintf("CONNECT to port %d is not allowed", port)}
+	}
+
+	req := rules.Request{Host: host, Port: port}
+
+	if e.deny.Evaluate(req) != "" {
+		return &DeniedError{Reason: fmt.Sprintf("Destination %s is denied by policy", host)}
+	}
+
+	if e.allow != nil && e.allow.Evaluate(req) == "" {
+		return &DeniedError{Reason: fmt.Sprintf("Destination %s is not allowed by policy", host)}
+	}
+
+	return nil
+}
+
+// compileDestinations builds a rule matching any of the given host globs and CIDRs
+func compileDestinations(destinations []string) (*rules.Rules, error) {
+	if len(destinations) == 0 {
+		return nil, nil
+	}
+
+	rule := rules.Rule{Action: "MATCH"}
+	for _, destination := range destinations {
+		if strings.Contains(destination, "/") || net.ParseIP(destination) != nil {
+			rule.CIDRs = append(rule.CIDRs, destination)
+		} else {
+			rule.Hosts = append(rule.Hosts, destination)
+		}
+	}
+
+	return rules.Compile([]rules.Rule{rule})
+}
@@ -0,0 +1,52 @@
+package policy_test
+
+import (
+	. "github.com/mikesimons/pacyak/policy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy", func() {
+	Describe("Compile", func() {
+		It("should reject invalid destinations", func() {
+			_, err := Compile(Policy{Deny: []string{"10.0.0.0/33"}})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Check", func() {
+		It("should allow everything when empty or nil", func() {
+			it, _ := Compile(Policy{})
+			Expect(it.Check("CONNECT", "google.com", 8443)).Should(Succeed())
+
+			var none *Enforcer
+			Expect(none.Check("GET", "google.com", 80)).Should(Succeed())
+		})
+
+		It("should deny listed hosts and networks", func() {
+			it, _ := Compile(Policy{Deny: []string{"*.telemetry.example", "10.0.0.0/8"}})
+			Expect(it.Check("GET", "v1.telemetry.example", 443)).Should(BeAssignableToTypeOf(&DeniedError{}))
+			Expect(it.Check("CONNECT", "10.1.2.3", 22)).Should(BeAssignableToTypeOf(&DeniedError{}))
+			Expect(it.Check("GET", "google.com", 80)).Should(Succeed())
+		})
+
+		It("should only allow listed destinations when an allow list is set", func() {
+			it, _ := Compile(Policy{Allow: []string{"*.corp", "192.168.0.0/16"}, Deny: []string{"secret.corp"}})
+			Expect(it.Check("GET", "wiki.corp", 80)).Should(Succeed())
+			Expect(it.Check("GET", "192.168.1.1", 80)).Should(Succeed())
+			Expect(it.Check("GET", "google.com", 80)).Should(BeAssignableToTypeOf(&DeniedError{}))
+			Expect(it.Check("GET", "secret.corp", 80)).Should(BeAssignableToTypeOf(&DeniedError{}))
+		})
+
+		It("should restrict CONNECT ports", func() {
+			it, _ := Compile(Policy{ConnectPorts: []int{443, 22}})
+			Expect(it.Check("CONNECT", "github.com", 22)).Should(Succeed())
+			Expect(it.Check("GET", "github.com", 8080)).Should(Succeed())
+
+			err := it.Check("CONNECT", "db.corp", 5432)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("5432"))
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mikesimons/pacyak/resolver"
+)
+
+// Binding selects the local end of outgoing connections
+type Binding struct {
+	// Interface is the network interface connections leave from. On Linux this is enforced with SO_BINDTODEVICE;
+	// elsewhere connections are made from the interface's address.
+	Interface string
+	// SourceAddress is the local IP connections are made from
+	SourceAddress string
+}
+
+// IsZero reports whether connections are left to the routing table
+func (b Binding) IsZero() bool {
+	return b == Binding{}
+}
+
+// String describes the binding for logs and cache keys
+func (b Binding) String() string {
+	return fmt.Sprintf("%s@%s", b.Interface, b.SourceAddress)
+}
+
+// newDialContext returns the dial function for outgoing connections made according to b
+func newDialContext(b Binding) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if b.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(b.SourceAddress)}
+	}
+
+	if b.Interface == "" {
+		return dialer.DialContext
+	}
+
+	if control := bindControl(b.Interface); control != nil {
+		dialer.Control = control
+		return dialer.DialContext
+	}
+
+	if b.SourceAddress != "" {
+		return dialer.DialContext
+	}
+
+	// The interface's address is looked up for every dial as it changes when networks come and go
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ip, err := interfaceAddress(b.Interface)
+		if err != nil {
+			return nil, err
+		}
+
+		if network == "tcp" {
+			network = "tcp6"
+			if ip.To4() != nil {
+				network = "tcp4"
+			}
+		}
+
+		bound := *dialer
+		bound.LocalAddr = &net.TCPAddr{IP: ip}
+		return bound.DialContext(ctx, network, addr)
+	}
+}
+
+// resolvingDialContext looks up host names with r and dials each address in turn until one connects.
+// Addresses are passed straight to dial.
+func resolvingDialContext(r resolver.Resolver, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+		}
+
+		return nil, err
+	}
+}
+
+// interfaceAddress returns the first IPv4 address of the named interface, or its first IPv6 address if it has none
+func interfaceAddress(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("Interface %s has no address", name)
+	}
+
+	return found, nil
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import "syscall"
+
+// bindControl returns a dialer control function binding sockets to the named interface
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
@@ -0,0 +1,76 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/mikesimons/pacyak/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Binding", func() {
+	var origin *httptest.Server
+
+	// get requests the origin through a server running handler and returns the client address the origin saw
+	get := func(handler http.Handler) (string, error) {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		response, err := client.Get(origin.URL)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return "", &UpstreamError{StatusCode: response.StatusCode}
+		}
+
+		body, err := ioutil.ReadAll(response.Body)
+		return string(body), err
+	}
+
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			w.Write([]byte(host))
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("should make direct connections from the source address", func() {
+		Expect(get(NewWithOpts("direct", &Opts{Bind: Binding{SourceAddress: "127.0.0.2"}}))).Should(Equal("127.0.0.2"))
+	})
+
+	It("should make direct connections through the interface", func() {
+		Expect(get(NewWithOpts("direct", &Opts{Bind: Binding{Interface: "lo"}}))).Should(Equal("127.0.0.1"))
+
+		_, err := get(NewWithOpts("direct", &Opts{Bind: Binding{Interface: "pacyak-none0"}}))
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should connect to upstream proxies from the source address", func() {
+		seen := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			seen <- host
+			New("direct").ServeHTTP(w, r)
+		}))
+		defer upstream.Close()
+
+		proxy := NewWithOpts(upstream.Listener.Addr().String(), &Opts{Bind: Binding{SourceAddress: "127.0.0.3"}})
+		Expect(get(proxy)).Should(Equal("127.0.0.1"))
+		Expect(<-seen).Should(Equal("127.0.0.3"))
+	})
+})
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// bindControl is only implemented on Linux; elsewhere connections are bound by the interface's address
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -1,36 +1,116 @@
 package proxy
 
 import (
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-// filterRequestHeaders removes headers that a proxy should remove
+// hopByHopHeaders apply to a single connection and must not be forwarded (RFC 7230 section 6.1)
+// Proxy-Connection is not standard but old clients still send it
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes hop-by-hop headers, including any named in Connection, except those in keep
+func removeHopByHopHeaders(header http.Header, keep ...string) {
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				header.Del(token)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		kept := false
+		for _, k := range keep {
+			kept = kept || strings.EqualFold(k, name)
+		}
+
+		if !kept {
+			header.Del(name)
+		}
+	}
+}
+
+// addVia appends this proxy to the Via header (RFC 7230 section 5.7.1)
+func addVia(header http.Header, major, minor int) {
+	via := fmt.Sprintf("%d.%d pacyak", major, minor)
+	if prior := header.Get("Via"); prior != "" {
+		via = prior + ", " + via
+	}
+	header.Set("Via", via)
+}
+
+// filterRequestHeaders removes headers that a proxy should remove and adds Via / X-Forwarded-For if configured
+// Proxy-Authorization is kept when forwarding auth to an upstream proxy; it must never reach an origin server
 // Derived from github.com/elazarl/go-proxy
 func (proxy *Proxy) filterRequestHeaders(r *http.Request) {
-	r.Header.Del("Accept-Encoding")
-	r.Header.Del("Proxy-Connection")
-	r.Header.Del("Proxy-Authenticate")
-	r.Header.Del("Proxy-Authorization")
-	r.Header.Del("Connection")
+	var keep []string
+	if proxy.opts.ForwardAuth {
+		if upstream, err := proxy.Tr.Proxy(r); err == nil && upstream != nil {
+			keep = append(keep, "Proxy-Authorization")
+		}
+	}
+
+	removeHopByHopHeaders(r.Header, keep...)
+
+	if proxy.opts.Via {
+		addVia(r.Header, r.ProtoMajor, r.ProtoMinor)
+	}
+
+	if proxy.opts.ForwardedFor {
+		if client, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+				client = prior + ", " + client
+			}
+			r.Header.Set("X-Forwarded-For", client)
+		}
+	}
 }
 
 // makeUpstreamRequest roundtrips the given request and handles errors from that
+// The request carries the client connection's context so the upstream request is cancelled if the client goes away
 func (proxy *Proxy) makeUpstreamRequest(request *http.Request) (*http.Response, bool) {
 	response, err := proxy.Tr.RoundTrip(request)
 
-	if err != nil {
+	if err != nil && request.Context().Err() != nil {
+		log.WithFields(log.Fields{"url": request.URL.String()}).Debug("Client went away; upstream request cancelled")
+	} else if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Error performing roundtrip")
 	}
 
 	return response, err == nil
 }
 
-// copyResponse copies headers, status and body from an upstream request to a response
+// copyResponse copies headers, status, body and trailers from an upstream request to a response
 // Derived from github.com/elazarl/go-proxy
 func (proxy *Proxy) copyResponse(upstream *http.Response, response http.ResponseWriter) {
+	// Proxy-Authenticate is hop-by-hop but when forwarding auth the challenge is meant for the client
+	var keep []string
+	if proxy.opts.ForwardAuth {
+		keep = append(keep, "Proxy-Authenticate")
+	}
+	removeHopByHopHeaders(upstream.Header, keep...)
+
+	if proxy.opts.Via {
+		addVia(upstream.Header, upstream.ProtoMajor, upstream.ProtoMinor)
+	}
+
 	// Copy headers
 	headers := response.Header()
 	for header, values := range upstream.Header {
@@ -40,9 +120,27 @@ func (proxy *Proxy) copyResponse(upstream *http.Response, response http.Response
 		}
 	}
 
+	// Trailer values only arrive after the body but the client must be told to expect them up front
+	if len(upstream.Trailer) > 0 {
+		var names []string
+		for name := range upstream.Trailer {
+			names = append(names, name)
+		}
+		headers.Set("Trailer", strings.Join(names, ", "))
+	}
+
 	// Copy status code & body
 	response.WriteHeader(upstream.StatusCode)
-	_, err := io.Copy(response, upstream.Body)
+
+	var writer io.Writer = response
+	if flusher, ok := response.(http.Flusher); ok && isStreaming(upstream) {
+		flusher.Flush()
+		writer = &flushWriter{writer: response, flusher: flusher}
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	_, err := io.CopyBuffer(writer, readerOnly{upstream.Body}, *buf)
+	bufferPool.Put(buf)
 
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Error copying body")
@@ -53,4 +151,33 @@ func (proxy *Proxy) copyResponse(upstream *http.Response, response http.Response
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Error closing body")
 	}
+
+	for name, values := range upstream.Trailer {
+		headers[name] = values
+	}
+}
+
+// isStreaming reports whether a response should be passed on as it arrives rather than as buffers fill.
+// Event streams obviously are; bodies of unknown length are usually chunked streams or long polls.
+func isStreaming(response *http.Response) bool {
+	if response.ContentLength < 0 {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// flushWriter flushes after every write so data reaches the client as soon as upstream sends it
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if n > 0 {
+		w.flusher.Flush()
+	}
+	return n, err
 }
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/mikesimons/earl"
+	"golang.org/x/net/http2"
+)
+
+// http2ConnectDialer establishes tunnels as CONNECT streams multiplexed over HTTP/2 connections to the proxy.
+// https proxies negotiate HTTP/2 with TLS; others must accept it with prior knowledge (h2c).
+func (proxy *Proxy) http2ConnectDialer(https_proxy string) func(ctx context.Context, network, addr string, header http.Header) (net.Conn, error) {
+	u := earl.ParseWithDefaults(https_proxy, &earl.URL{Scheme: "auto", Port: "80"})
+
+	scheme := "http"
+	if u.Scheme == "https" {
+		scheme = "https"
+	}
+
+	transport := &http2.Transport{
+		AllowHTTP:       true,
+		TLSClientConfig: proxy.Tr.TLSClientConfig,
+		ReadIdleTimeout: 30 * time.Second,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := proxy.Tr.DialContext(ctx, network, addr)
+			if err != nil || scheme != "https" {
+				return conn, err
+			}
+
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		},
+	}
+
+	proxy.closers = append(proxy.closers, transport.CloseIdleConnections)
+
+	return func(ctx context.Context, network, addr string, header http.Header) (net.Conn, error) {
+		if header == nil {
+			header = make(http.Header)
+		}
+
+		// The stream outlives ctx, which only bounds establishing it
+		streamCtx, cancel := context.WithCancel(context.Background())
+		established := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-established:
+			}
+		}()
+
+		reader, writer := io.Pipe()
+		request := (&http.Request{
+			Method:        "CONNECT",
+			URL:           &url.URL{Scheme: scheme, Host: u.HostAndPort()},
+			Host:          addr,
+			Header:        header,
+			Body:          reader,
+			ContentLength: -1,
+		}).WithContext(streamCtx)
+
+		response, err := transport.RoundTrip(request)
+		close(established)
+
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("Proxy refused connection: %s", err)
+		}
+
+		if response.StatusCode != 200 {
+			responseText, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			writer.Close()
+			cancel()
+			return nil, &UpstreamError{StatusCode: response.StatusCode, Header: response.Header, Body: responseText}
+		}
+
+		return &clientStream{reader: response.Body, writer: writer, cancel: cancel, addr: streamAddr(addr)}, nil
+	}
+}
+
+// clientStream is a tunnel carried by an HTTP/2 CONNECT stream to an upstream proxy
+type clientStream struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+	addr   streamAddr
+}
+
+func (s *clientStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *clientStream) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+// CloseWrite ends the request stream so the proxy sees the end of our data
+func (s *clientStream) CloseWrite() error {
+	return s.writer.Close()
+}
+
+func (s *clientStream) Close() error {
+	s.writer.Close()
+	err := s.reader.Close()
+	s.cancel()
+	return err
+}
+
+func (s *clientStream) LocalAddr() net.Addr  { return streamAddr("") }
+func (s *clientStream) RemoteAddr() net.Addr { return s.addr }
+
+// Streams share their connection so deadlines can't be set on them; tunnels use their idle timeout instead
+func (s *clientStream) SetDeadline(t time.Time) error      { return os.ErrNoDeadline }
+func (s *clientStream) SetReadDeadline(t time.Time) error  { return os.ErrNoDeadline }
+func (s *clientStream) SetWriteDeadline(t time.Time) error { return os.ErrNoDeadline }
+
+// streamAddr is the address a CONNECT stream leads to
+type streamAddr string
+
+func (a streamAddr) Network() string { return "h2" }
+func (a streamAddr) String() string  { return string(a) }
+
+// serverStream is a tunnel carried by an HTTP/2 CONNECT stream from a client.
+// HTTP/2 connections can't be hijacked so the request body and response are the two halves of the tunnel.
+type serverStream struct {
+	body     io.ReadCloser
+	response http.ResponseWriter
+	flusher  http.Flusher
+}
+
+func newServerStream(request *http.Request, response http.ResponseWriter) (*serverStream, error) {
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response can't be flushed")
+	}
+
+	return &serverStream{body: request.Body, response: response, flusher: flusher}, nil
+}
+
+func (s *serverStream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *serverStream) Write(p []byte) (int, error) {
+	n, err := s.response.Write(p)
+	s.flusher.Flush()
+	return n, err
+}
+
+// Close stops reading from the client; the response stream ends when the handler returns
+func (s *serverStream) Close() error {
+	return s.body.Close()
+}
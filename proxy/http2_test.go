@@ -0,0 +1,135 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+
+	. "github.com/mikesimons/pacyak/proxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// newH2CServer serves handler over HTTP/2 with prior knowledge
+func newH2CServer(handler http.Handler) (*httptest.Server, *countingListener) {
+	server := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	listener := &countingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	return server, listener
+}
+
+var _ = Describe("HTTP/2", func() {
+	var target net.Listener
+
+	BeforeEach(func() {
+		target = newEchoServer()
+	})
+
+	AfterEach(func() {
+		target.Close()
+	})
+
+	It("should tunnel CONNECT requests from HTTP/2 clients", func() {
+		server, _ := newH2CServer(New("direct"))
+		defer server.Close()
+
+		transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}
+
+		reader, writer := io.Pipe()
+		response, err := transport.RoundTrip(&http.Request{
+			Method:        "CONNECT",
+			URL:           &url.URL{Scheme: "http", Host: server.Listener.Addr().String()},
+			Host:          target.Addr().String(),
+			Header:        make(http.Header),
+			Body:          reader,
+			ContentLength: -1,
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		defer response.Body.Close()
+		Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+		io.WriteString(writer, "hello\n")
+		Expect(bufio.NewReader(response.Body).ReadString('\n')).Should(Equal("hello\n"))
+	})
+
+	Context("to an upstream proxy", func() {
+		It("should multiplex tunnels over one connection", func() {
+			upstream, listener := newH2CServer(New("direct"))
+			defer upstream.Close()
+
+			proxy := NewWithOpts(upstream.Listener.Addr().String(), &Opts{HTTP2: true})
+
+			for i := 0; i < 5; i++ {
+				conn, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+				Expect(err).ShouldNot(HaveOccurred())
+				defer conn.Close()
+
+				io.WriteString(conn, "hello\n")
+				Expect(bufio.NewReader(conn).ReadString('\n')).Should(Equal("hello\n"))
+			}
+
+			Expect(atomic.LoadInt32(&listener.accepted)).Should(Equal(int32(1)))
+		})
+
+		It("should half-close the stream so the remote can finish replying", func() {
+			upstream, _ := newH2CServer(New("direct"))
+			defer upstream.Close()
+
+			proxy := NewWithOpts(upstream.Listener.Addr().String(), &Opts{HTTP2: true})
+
+			conn, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+
+			io.WriteString(conn, "hello")
+			conn.(interface{ CloseWrite() error }).CloseWrite()
+
+			Expect(ioutil.ReadAll(conn)).Should(Equal([]byte("hello")))
+		})
+
+		It("should return the upstream proxy's refusal", func() {
+			upstream, _ := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Proxy-Authenticate", `Basic realm="corp"`)
+				w.WriteHeader(http.StatusProxyAuthRequired)
+			}))
+			defer upstream.Close()
+
+			proxy := NewWithOpts(upstream.Listener.Addr().String(), &Opts{HTTP2: true})
+
+			_, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).Should(BeAssignableToTypeOf(&UpstreamError{}))
+			Expect(err.(*UpstreamError).StatusCode).Should(Equal(http.StatusProxyAuthRequired))
+			Expect(err.(*UpstreamError).Header.Get("Proxy-Authenticate")).Should(Equal(`Basic realm="corp"`))
+		})
+	})
+})
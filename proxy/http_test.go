@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	. "github.com/mikesimons/pacyak/proxy"
+
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP headers", func() {
+	var origin *httptest.Server
+	var received http.Header
+
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("Proxy-Authenticate", `Basic realm="origin"`)
+			w.Header().Set("X-End", "1")
+
+			if r.Header.Get("Accept-Encoding") == "gzip" {
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write([]byte("hello"))
+				gz.Close()
+				return
+			}
+
+			w.Write([]byte("hello"))
+		}))
+	})
+
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	get := func(proxy *Proxy, header http.Header) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		request.RemoteAddr = "192.0.2.10:51234"
+		for key, values := range header {
+			request.Header[key] = values
+		}
+
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	Describe("requests", func() {
+		It("should remove hop-by-hop headers and those named in Connection", func() {
+			get(New("direct"), http.Header{
+				"Connection":          {"X-Custom, Keep-Alive"},
+				"X-Custom":            {"1"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Proxy-Authorization": {"Basic YWxpY2U6c2VjcmV0"},
+				"Te":                  {"trailers"},
+				"Upgrade":             {"h2c"},
+				"X-End":               {"1"},
+			})
+
+			for _, name := range []string{"X-Custom", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Upgrade"} {
+				Expect(received).ShouldNot(HaveKey(name))
+			}
+			Expect(received.Get("X-End")).Should(Equal("1"))
+		})
+
+		It("should pass Accept-Encoding through and leave the body compressed", func() {
+			recorder := get(New("direct"), http.Header{"Accept-Encoding": {"gzip"}})
+			Expect(received.Get("Accept-Encoding")).Should(Equal("gzip"))
+			Expect(recorder.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+
+			reader, err := gzip.NewReader(recorder.Body)
+			Expect(err).ShouldNot(HaveOccurred())
+			buf := make([]byte, 5)
+			reader.Read(buf)
+			Expect(string(buf)).Should(Equal("hello"))
+		})
+
+		It("should not add Via or X-Forwarded-For by default", func() {
+			get(New("direct"), nil)
+			Expect(received).ShouldNot(HaveKey("Via"))
+			Expect(received).ShouldNot(HaveKey("X-Forwarded-For"))
+		})
+
+		It("should add Via and X-Forwarded-For when enabled", func() {
+			get(NewWithOpts("direct", &Opts{Via: true, ForwardedFor: true}), http.Header{
+				"Via":             {"1.1 squid"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			})
+			Expect(received.Get("Via")).Should(Equal("1.1 squid, 1.1 pacyak"))
+			Expect(received.Get("X-Forwarded-For")).Should(Equal("198.51.100.1, 192.0.2.10"))
+		})
+	})
+
+	Describe("responses", func() {
+		It("should remove hop-by-hop headers and those named in Connection", func() {
+			recorder := get(New("direct"), nil)
+			Expect(recorder.Code).Should(Equal(http.StatusOK))
+
+			for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+				Expect(recorder.Header()).ShouldNot(HaveKey(name))
+			}
+			Expect(recorder.Header().Get("X-End")).Should(Equal("1"))
+			Expect(recorder.Body.String()).Should(Equal("hello"))
+		})
+
+		It("should add Via when enabled", func() {
+			recorder := get(NewWithOpts("direct", &Opts{Via: true}), nil)
+			Expect(recorder.Header().Get("Via")).Should(Equal("1.1 pacyak"))
+		})
+	})
+})
@@ -1,7 +1,8 @@
 package proxy
 
 import (
-	"io"
+	"bufio"
+	"context"
 	"net"
 	"net/http"
 
@@ -9,6 +10,7 @@ import (
 )
 
 // hijack will attempt to hijack the given response to send raw data
+// Anything the client sent after the request that the server has already read is replayed by the returned conn
 func (proxy *Proxy) hijack(response http.ResponseWriter) (net.Conn, bool) {
 	hijacker, ok := response.(http.Hijacker)
 	if !ok {
@@ -18,7 +20,7 @@ func (proxy *Proxy) hijack(response http.ResponseWriter) (net.Conn, bool) {
 		return nil, false
 	}
 
-	hijacked, _, err := hijacker.Hijack()
+	hijacked, buffered, err := hijacker.Hijack()
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Could not hijack connection")
 		response.WriteHeader(502)
@@ -26,27 +28,68 @@ func (proxy *Proxy) hijack(response http.ResponseWriter) (net.Conn, bool) {
 		return nil, false
 	}
 
+	if buffered != nil && buffered.Reader.Buffered() > 0 {
+		return &bufferedConn{Conn: hijacked, reader: buffered.Reader}, true
+	}
+
 	return hijacked, true
 }
 
+// bufferedConn is a hijacked connection whose reads start with the data the server had already buffered
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
 // connectDial connects to the given addr for a CONNECT request using either an overridden dialer or the default if not set.
+// header is sent to upstream HTTP proxies with the CONNECT request.
 // Derived from github.com/elazarl/go-proxy
-func (proxy *Proxy) connectDial(network, addr string) (c net.Conn, err error) {
+func (proxy *Proxy) connectDial(ctx context.Context, network, addr string, header http.Header) (c net.Conn, err error) {
+	if proxy.connectWithHeader != nil {
+		return proxy.connectWithHeader(ctx, network, addr, header)
+	}
 	if proxy.ConnectDial == nil {
-		return proxy.Tr.Dial(network, addr)
+		return proxy.Tr.DialContext(ctx, network, addr)
 	}
-	return proxy.ConnectDial(network, addr)
+	return proxy.ConnectDial(ctx, network, addr)
 }
 
-// copyAndClose pumps data from one connection to the other and closes once data ceases flowing.
-// Derived from github.com/elazarl/go-proxy
-func copyAndClose(w, r net.Conn) {
-	// Lots of "read connection reset by peer" errs if we both with the error here
-	// That's because the server may terminate connection at will
-	// There is nothing we can do about that so we ignore it
-	io.Copy(w, r)
-	err := r.Close()
-	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Error("Error closing connection")
+// forwardedHeader returns the client headers to send with a CONNECT request to the upstream proxy
+func (proxy *Proxy) forwardedHeader(request *http.Request) http.Header {
+	if !proxy.opts.ForwardAuth || request.Header.Get("Proxy-Authorization") == "" {
+		return nil
 	}
+
+	header := make(http.Header)
+	header.Set("Proxy-Authorization", request.Header.Get("Proxy-Authorization"))
+	return header
+}
+
+// relayUpstreamError sends an upstream proxy's refusal of a CONNECT request to the client as it was received
+func (proxy *Proxy) relayUpstreamError(response http.ResponseWriter, upstreamErr *UpstreamError) {
+	log.WithFields(log.Fields{"status": upstreamErr.StatusCode}).Debug("Relaying upstream proxy response")
+
+	headers := response.Header()
+	for header, values := range upstreamErr.Header {
+		if header == "Content-Length" || header == "Connection" || header == "Transfer-Encoding" {
+			continue
+		}
+		for _, value := range values {
+			headers.Add(header, value)
+		}
+	}
+
+	response.WriteHeader(upstreamErr.StatusCode)
+	response.Write(upstreamErr.Body)
 }
@@ -0,0 +1,90 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/mikesimons/pacyak/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTPS proxies", func() {
+	var upstream *httptest.Server
+	var trusted *tls.Config
+	var target net.Listener
+
+	BeforeEach(func() {
+		upstream = httptest.NewUnstartedServer(New("direct"))
+		upstream.EnableHTTP2 = true
+		upstream.StartTLS()
+
+		pool := x509.NewCertPool()
+		pool.AddCert(upstream.Certificate())
+		trusted = &tls.Config{RootCAs: pool}
+
+		target = newEchoServer()
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		target.Close()
+	})
+
+	// echo opens a tunnel to target through proxy and checks data makes the round trip
+	echo := func(proxy *Proxy) error {
+		conn, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		io.WriteString(conn, "hello\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && line != "hello\n" {
+			err = fmt.Errorf("unexpected reply %q", line)
+		}
+		return err
+	}
+
+	It("should tunnel over TLS to the proxy", func() {
+		Expect(echo(NewWithOpts("https://"+upstream.Listener.Addr().String(), &Opts{TLSConfig: trusted}))).Should(Succeed())
+	})
+
+	It("should multiplex tunnels over HTTP/2 negotiated with TLS", func() {
+		Expect(echo(NewWithOpts("https://"+upstream.Listener.Addr().String(), &Opts{TLSConfig: trusted, HTTP2: true}))).Should(Succeed())
+	})
+
+	It("should refuse proxies whose certificate isn't trusted", func() {
+		Expect(echo(NewWithOpts("https://"+upstream.Listener.Addr().String(), &Opts{}))).ShouldNot(Succeed())
+	})
+
+	It("should send plain HTTP requests over TLS to the proxy", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+		defer origin.Close()
+
+		server := httptest.NewServer(NewWithOpts("https://"+upstream.Listener.Addr().String(), &Opts{TLSConfig: trusted}))
+		defer server.Close()
+
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		response, err := client.Get(origin.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer response.Body.Close()
+
+		Expect(ioutil.ReadAll(response.Body)).Should(Equal([]byte("hello")))
+	})
+})
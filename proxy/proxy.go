@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -9,41 +10,109 @@ import (
 	"net/http"
 	"net/url"
 	"os/exec"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mikesimons/earl"
+	"github.com/mikesimons/pacyak/resolver"
+	"golang.org/x/crypto/ssh"
 )
 
 // Proxy is a simple proxy implementation
 type Proxy struct {
 	Tr            *http.Transport
 	DirectHandler http.Handler
-	ConnectDial   func(network string, addr string) (net.Conn, error)
+	ConnectDial   func(ctx context.Context, network string, addr string) (net.Conn, error)
 	Logger        *log.Logger
 	Available     func() bool
+
+	opts Opts
+
+	// connectWithHeader is the CONNECT dialer for HTTP proxies; it can send client headers upstream
+	connectWithHeader func(ctx context.Context, network, addr string, header http.Header) (net.Conn, error)
+
+	// closers release upstream connections held beyond Tr's idle pool
+	closers []func()
+
+	// users counts the requests being served; once closing, the last of them to finish runs the closers
+	lock      sync.Mutex
+	users     int
+	closing   bool
+	closeOnce sync.Once
+}
+
+// Opts holds configuration options for Proxy
+type Opts struct {
+	// ForwardAuth passes the client's Proxy-Authorization header to an upstream HTTP proxy and relays its responses
+	// (such as 407 challenges) to the client. It has no effect on direct and SOCKS proxies.
+	ForwardAuth bool
+	// Via adds pacyak to the Via header of requests and responses
+	Via bool
+	// ForwardedFor appends the client address to the X-Forwarded-For header of plain HTTP requests
+	ForwardedFor bool
+	// IdleTimeout closes CONNECT and upgraded tunnels that carry no data in either direction for this long.
+	// Zero means tunnels never time out.
+	IdleTimeout time.Duration
+	// HTTP2 sends CONNECT requests to an upstream HTTP proxy as streams over shared HTTP/2 connections rather than
+	// a connection each. The proxy must support HTTP/2: over TLS for https proxies, or with prior knowledge otherwise.
+	// Plain HTTP requests still use HTTP/1.1.
+	HTTP2 bool
+	// TLSConfig is used for connections to https proxies, for example to trust a private CA or present a client
+	// certificate. Nil means the Go defaults.
+	TLSConfig *tls.Config
+	// SSHConfig returns the settings for connecting to an ssh:// bastion as user (empty if none was given).
+	// ssh:// proxies can't connect without it.
+	SSHConfig func(user, addr string) *ssh.ClientConfig
+	// Bind sets the interface and source address of outgoing connections: to destinations for direct proxies and to
+	// the upstream proxy otherwise
+	Bind Binding
+	// Resolver looks up the names of destinations for direct proxies and of the upstream proxy otherwise.
+	// Nil means the system resolver.
+	Resolver resolver.Resolver
+}
+
+// UpstreamError is returned when an upstream proxy refuses a CONNECT request
+type UpstreamError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("Proxy error: %d %s", e.StatusCode, string(e.Body))
 }
 
 // connectDialer establishes a connection for use with a CONNECT request
 // This code is largely derived from github.com/elazarl/go-proxy
-func (proxy *Proxy) connectDialer(https_proxy string) func(network, addr string) (net.Conn, error) {
+func (proxy *Proxy) connectDialer(https_proxy string) func(ctx context.Context, network, addr string, header http.Header) (net.Conn, error) {
 	u := earl.ParseWithDefaults(https_proxy, &earl.URL{Scheme: "auto", Port: "80"})
 
-	return func(network, addr string) (net.Conn, error) {
-		client, err := proxy.Tr.Dial(network, u.HostAndPort())
+	return func(ctx context.Context, network, addr string, header http.Header) (net.Conn, error) {
+		client, err := proxy.Tr.DialContext(ctx, network, u.HostAndPort())
 		if err != nil {
 			return nil, fmt.Errorf("Proxy refused connection: %s", err)
 		}
 
 		if u.Scheme == "https" {
-			client = tls.Client(client, proxy.Tr.TLSClientConfig)
+			tlsClient := tls.Client(client, tlsConfigFor(proxy.Tr.TLSClientConfig, u.Host))
+			if err := tlsClient.HandshakeContext(ctx); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("TLS handshake with proxy failed: %s", err)
+			}
+			client = tlsClient
+		}
+
+		if header == nil {
+			header = make(http.Header)
 		}
 
 		request := &http.Request{
 			Method: "CONNECT",
 			URL:    &url.URL{Opaque: addr},
 			Host:   addr,
-			Header: make(http.Header),
+			Header: header,
 		}
 
 		request.Write(client)
@@ -59,25 +128,59 @@ func (proxy *Proxy) connectDialer(https_proxy string) func(network, addr string)
 			responseText, _ := ioutil.ReadAll(response.Body)
 			response.Body.Close()
 			client.Close()
-			return nil, fmt.Errorf("Proxy error: %s", string(responseText))
+			return nil, &UpstreamError{StatusCode: response.StatusCode, Header: response.Header, Body: responseText}
 		}
 
 		return client, nil
 	}
 }
 
+// sshURL parses an ssh://[user@]host[:port] proxy URL, returning the user separately
+func sshURL(proxyURLString string) (*earl.URL, string) {
+	user := ""
+	rest := strings.TrimPrefix(proxyURLString, "ssh://")
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		user, rest = rest[:i], rest[i+1:]
+	}
+
+	return earl.ParseWithDefaults("ssh://"+rest, &earl.URL{Port: "22"}), user
+}
+
+// tlsConfigFor returns a copy of config for connecting to host
+func tlsConfigFor(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		return &tls.Config{ServerName: host}
+	}
+
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
 // New creates a new instance of Proxy. "direct" is a special case URL that simply passes data through.
+// socks4:// and socks5:// URLs tunnel both HTTP and CONNECT requests through a SOCKS proxy.
+// https:// URLs are HTTP proxies reached over TLS and ssh://user@host URLs tunnel through an SSH bastion.
 func New(proxyURLString string) *Proxy {
+	return NewWithOpts(proxyURLString, &Opts{})
+}
+
+// NewWithOpts creates a new instance of Proxy with non-default options
+func NewWithOpts(proxyURLString string, opts *Opts) *Proxy {
+	dial := newDialContext(opts.Bind)
+	if opts.Resolver != nil {
+		dial = resolvingDialContext(opts.Resolver, dial)
+	}
+
 	proxy := &Proxy{
+		opts: *opts,
 		Tr: &http.Transport{
 			TLSHandshakeTimeout:   10 * time.Second,
 			ExpectContinueTimeout: 1 * time.Second,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			IdleConnTimeout: 90 * time.Second,
-			Dial:            net.Dial,
+			DialContext:           dial,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       opts.TLSConfig,
 		},
 	}
 
@@ -85,21 +188,94 @@ func New(proxyURLString string) *Proxy {
 		proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) { return nil, nil }
 		proxy.Available = func() bool { return true }
 		proxy.ConnectDial = nil
+	} else if strings.HasPrefix(proxyURLString, "socks4://") || strings.HasPrefix(proxyURLString, "socks5://") {
+		proxyURL := earl.ParseWithDefaults(proxyURLString, &earl.URL{Port: "1080"})
+		socksDial := socksDialer(proxyURL.Scheme, proxyURL.HostAndPort(), dial)
+		proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) { return nil, nil }
+		proxy.Tr.DialContext = socksDial
+		proxy.Available = func() bool { return exec.Command("ping", "-w", "1", proxyURL.Host).Run() == nil }
+		proxy.ConnectDial = socksDial
+	} else if strings.HasPrefix(proxyURLString, "ssh://") {
+		proxyURL, user := sshURL(proxyURLString)
+		transport := newSSHTransport(user, proxyURL.HostAndPort(), opts.SSHConfig, dial)
+		proxy.closers = append(proxy.closers, func() { transport.Close() })
+		sshDial := transport.DialContext
+		proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) { return nil, nil }
+		proxy.Tr.DialContext = sshDial
+		proxy.Available = func() bool { return exec.Command("ping", "-w", "1", proxyURL.Host).Run() == nil }
+		proxy.ConnectDial = sshDial
 	} else {
 		proxyURL := earl.ParseWithDefaults(proxyURLString, &earl.URL{Scheme: "auto"})
 		proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) { return proxyURL.ToNetURL(), nil }
 		proxy.Available = func() bool { return exec.Command("ping", "-w", "1", proxyURL.Host).Run() == nil }
-		proxy.ConnectDial = proxy.connectDialer(proxyURL.ToNetURL().String())
+		if opts.HTTP2 {
+			proxy.connectWithHeader = proxy.http2ConnectDialer(proxyURL.ToNetURL().String())
+		} else {
+			proxy.connectWithHeader = proxy.connectDialer(proxyURL.ToNetURL().String())
+		}
+		proxy.ConnectDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return proxy.connectWithHeader(ctx, network, addr, nil)
+		}
 	}
 
 	return proxy
 }
 
+// Close drops idle upstream connections and disconnects from any SSH bastion once the requests being served have
+// finished, tunnels included. It is called when the proxy is no longer handed out for new requests.
+func (proxy *Proxy) Close() {
+	proxy.lock.Lock()
+	proxy.closing = true
+	idle := proxy.users == 0
+	proxy.lock.Unlock()
+
+	if idle {
+		proxy.release()
+	}
+}
+
+// hold notes a request being served; it must be matched by a call to done
+func (proxy *Proxy) hold() {
+	proxy.lock.Lock()
+	proxy.users++
+	proxy.lock.Unlock()
+}
+
+// done notes a request has finished and releases the upstream connections if it was the last of a closed proxy
+func (proxy *Proxy) done() {
+	proxy.lock.Lock()
+	proxy.users--
+	last := proxy.closing && proxy.users == 0
+	proxy.lock.Unlock()
+
+	if last {
+		proxy.release()
+	}
+}
+
+// release drops idle upstream connections and runs the closers, once
+func (proxy *Proxy) release() {
+	proxy.closeOnce.Do(func() {
+		proxy.Tr.CloseIdleConnections()
+		for _, closer := range proxy.closers {
+			closer()
+		}
+	})
+}
+
 // ServeHTTP handles the actual http / https proxying
 // Derived from github.com/elazarl/go-proxy
 func (proxy *Proxy) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	proxy.hold()
+	defer proxy.done()
+
 	if request.Method == "CONNECT" {
-		remote, err := proxy.connectDial("tcp", request.URL.Host)
+		remote, err := proxy.connectDial(request.Context(), "tcp", request.URL.Host, proxy.forwardedHeader(request))
+		if upstreamErr, ok := err.(*UpstreamError); ok && proxy.opts.ForwardAuth {
+			proxy.relayUpstreamError(response, upstreamErr)
+			return
+		}
+
 		if err != nil {
 			log.WithFields(log.Fields{"host": request.URL.Host, "error": err}).Error("Unable to connect to remote host")
 			response.WriteHeader(502)
@@ -109,19 +285,42 @@ func (proxy *Proxy) ServeHTTP(response http.ResponseWriter, request *http.Reques
 			return
 		}
 
+		if request.ProtoMajor == 2 {
+			stream, err := newServerStream(request, response)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Could not open HTTP/2 tunnel")
+				remote.Close()
+				response.WriteHeader(502)
+				return
+			}
+
+			response.WriteHeader(200)
+			stream.flusher.Flush()
+
+			proxy.tunnel(request.URL.Host, stream, remote)
+			return
+		}
+
 		hijacked, ok := proxy.hijack(response)
 		if !ok {
+			remote.Close()
 			return
 		}
 
 		hijacked.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
-		go copyAndClose(remote, hijacked)
-		go copyAndClose(hijacked, remote)
+		proxy.tunnel(request.URL.Host, hijacked, remote)
+	} else if upgradeType(request.Header) != "" {
+		proxy.serveUpgrade(response, request)
 	} else {
 		proxy.filterRequestHeaders(request)
-		if upstreamResponse, ok := proxy.makeUpstreamRequest(request); ok {
-			proxy.copyResponse(upstreamResponse, response)
+		upstreamResponse, ok := proxy.makeUpstreamRequest(request)
+		if !ok {
+			response.WriteHeader(502)
+			response.Write([]byte("pacyak error: unable to connect to remote host"))
+			return
 		}
+
+		proxy.copyResponse(upstreamResponse, response)
 	}
 }
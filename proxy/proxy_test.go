@@ -0,0 +1,214 @@
+package proxy_test
+
+import (
+	. "github.com/mikesimons/pacyak/proxy"
+
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/mikesimons/pacyak/resolver"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeUpstream is an HTTP proxy that answers every request with a 407 and records what it was sent
+type fakeUpstream struct {
+	listener net.Listener
+	requests chan *http.Request
+}
+
+func newFakeUpstream() *fakeUpstream {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ShouldNot(HaveOccurred())
+
+	upstream := &fakeUpstream{listener: listener, requests: make(chan *http.Request, 10)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				upstream.requests <- request
+
+				conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n" +
+					"Proxy-Authenticate: Basic realm=\"corp\"\r\n" +
+					"Content-Length: 10\r\n\r\nlog in plz"))
+			}()
+		}
+	}()
+
+	return upstream
+}
+
+func (u *fakeUpstream) Addr() string {
+	return u.listener.Addr().String()
+}
+
+func (u *fakeUpstream) Close() {
+	u.listener.Close()
+}
+
+// connect sends a CONNECT request through the proxy served by server
+func connect(server *httptest.Server, header http.Header) *http.Response {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	Expect(err).ShouldNot(HaveOccurred())
+	defer conn.Close()
+
+	request, _ := http.NewRequest("CONNECT", "http://example.com:443", nil)
+	request.Host = "example.com:443"
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Write(conn)
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	Expect(err).ShouldNot(HaveOccurred())
+	return response
+}
+
+// newEchoServer returns a listener whose connections send back whatever they receive
+func newEchoServer() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ShouldNot(HaveOccurred())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+var _ = Describe("Proxy", func() {
+	var upstream *fakeUpstream
+
+	BeforeEach(func() {
+		upstream = newFakeUpstream()
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	credentials := http.Header{"Proxy-Authorization": {"Basic YWxpY2U6c2VjcmV0"}}
+
+	Describe("ForwardAuth", func() {
+		It("should forward client credentials with CONNECT and relay the 407", func() {
+			server := httptest.NewServer(NewWithOpts(upstream.Addr(), &Opts{ForwardAuth: true}))
+			defer server.Close()
+
+			response := connect(server, credentials)
+			Expect(response.StatusCode).Should(Equal(http.StatusProxyAuthRequired))
+			Expect(response.Header.Get("Proxy-Authenticate")).Should(Equal(`Basic realm="corp"`))
+			body, _ := ioutil.ReadAll(response.Body)
+			Expect(string(body)).Should(Equal("log in plz"))
+
+			var request *http.Request
+			Eventually(upstream.requests).Should(Receive(&request))
+			Expect(request.Method).Should(Equal("CONNECT"))
+			Expect(request.Header.Get("Proxy-Authorization")).Should(Equal("Basic YWxpY2U6c2VjcmV0"))
+		})
+
+		It("should forward client credentials with plain HTTP requests", func() {
+			server := httptest.NewServer(NewWithOpts(upstream.Addr(), &Opts{ForwardAuth: true}))
+			defer server.Close()
+
+			request, _ := http.NewRequest("GET", "http://example.com/", nil)
+			request.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+			server.Config.Handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			var upstreamRequest *http.Request
+			Eventually(upstream.requests).Should(Receive(&upstreamRequest))
+			Expect(upstreamRequest.Header.Get("Proxy-Authorization")).Should(Equal("Basic YWxpY2U6c2VjcmV0"))
+		})
+
+		It("should not forward client credentials by default", func() {
+			server := httptest.NewServer(New(upstream.Addr()))
+			defer server.Close()
+
+			response := connect(server, credentials)
+			Expect(response.StatusCode).Should(Equal(http.StatusBadGateway))
+
+			var request *http.Request
+			Eventually(upstream.requests).Should(Receive(&request))
+			Expect(request.Header.Get("Proxy-Authorization")).Should(Equal(""))
+		})
+	})
+
+	Describe("Resolver", func() {
+		var target net.Listener
+
+		BeforeEach(func() {
+			target = newEchoServer()
+		})
+
+		AfterEach(func() {
+			target.Close()
+		})
+
+		It("should resolve destinations of direct connections with it", func() {
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			defer origin.Close()
+
+			server := httptest.NewServer(NewWithOpts("direct", &Opts{Resolver: resolver.Static{"origin.test": {"127.0.0.1"}}}))
+			defer server.Close()
+
+			originURL, _ := url.Parse(origin.URL)
+			proxyURL, _ := url.Parse(server.URL)
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			response, err := client.Get("http://origin.test:" + originURL.Port() + "/")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer response.Body.Close()
+			Expect(ioutil.ReadAll(response.Body)).Should(Equal([]byte("hello")))
+		})
+
+		It("should resolve the upstream proxy's name with it", func() {
+			proxyServer := httptest.NewServer(New("direct"))
+			defer proxyServer.Close()
+
+			proxyURL, _ := url.Parse(proxyServer.URL)
+			proxy := NewWithOpts("http://proxy.test:"+proxyURL.Port(), &Opts{Resolver: resolver.Static{"proxy.test": {"::1", "127.0.0.1"}}})
+
+			conn, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).ShouldNot(HaveOccurred())
+			defer conn.Close()
+
+			io.WriteString(conn, "hello\n")
+			Expect(bufio.NewReader(conn).ReadString('\n')).Should(Equal("hello\n"))
+		})
+
+		It("should fail when the name can't be resolved", func() {
+			proxy := NewWithOpts("http://proxy.test:3128", &Opts{Resolver: resolver.Static{}})
+
+			_, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("no such host"))
+		})
+	})
+})
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// socksDialer establishes connections through a SOCKS4a or SOCKS5 proxy at server using dial to reach it
+// Only the unauthenticated variants of each protocol are supported
+func socksDialer(version string, server string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port in address %s", addr)
+		}
+
+		client, err := dial(ctx, "tcp", server)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS proxy refused connection: %s", err)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			client.SetDeadline(deadline)
+		}
+
+		if version == "socks4" {
+			err = socks4Handshake(client, host, uint16(port))
+		} else {
+			err = socks5Handshake(client, host, uint16(port))
+		}
+
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		client.SetDeadline(time.Time{})
+		return client, nil
+	}
+}
+
+// socks4Handshake performs a SOCKS4a CONNECT, letting the proxy resolve the host
+func socks4Handshake(conn net.Conn, host string, port uint16) error {
+	request := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(request[2:], port)
+
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(request, ip...)
+		request = append(request, 0)
+	} else {
+		request = append(request, 0, 0, 0, 1, 0)
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("Error writing SOCKS4 request: %s", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("Error reading SOCKS4 reply: %s", err)
+	}
+
+	if reply[1] != 90 {
+		return fmt.Errorf("SOCKS4 proxy rejected request (code %d)", reply[1])
+	}
+
+	return nil
+}
+
+// socks5Handshake performs an unauthenticated SOCKS5 CONNECT, letting the proxy resolve the host
+func socks5Handshake(conn net.Conn, host string, port uint16) error {
+	if len(host) > 255 {
+		return errors.New("SOCKS5 host name too long")
+	}
+
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return fmt.Errorf("Error writing SOCKS5 greeting: %s", err)
+	}
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return fmt.Errorf("Error reading SOCKS5 greeting: %s", err)
+	}
+
+	if greeting[0] != 5 || greeting[1] != 0 {
+		return errors.New("SOCKS5 proxy requires authentication")
+	}
+
+	request := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 1)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 4)
+		request = append(request, ip.To16()...)
+	} else {
+		request = append(request, 3, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("Error writing SOCKS5 request: %s", err)
+	}
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("Error reading SOCKS5 reply: %s", err)
+	}
+
+	if reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy rejected request (code %d)", reply[1])
+	}
+
+	// Discard the bound address; we have no use for it
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return fmt.Errorf("Error reading SOCKS5 reply: %s", err)
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy sent unknown address type %d", reply[3])
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("Error reading SOCKS5 reply: %s", err)
+	}
+
+	return nil
+}
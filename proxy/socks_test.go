@@ -0,0 +1,286 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	. "github.com/mikesimons/pacyak/proxy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// socksServer is a SOCKS4a and SOCKS5 proxy connecting to whatever it is asked for
+type socksServer struct {
+	listener net.Listener
+
+	// bound is the SOCKS5 address type and BND.ADDR sent in replies
+	bound []byte
+	// reject refuses every request
+	reject bool
+
+	lock      sync.Mutex
+	requested []string
+}
+
+func newSOCKSServer(bound []byte, reject bool) *socksServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ShouldNot(HaveOccurred())
+
+	server := &socksServer{listener: listener, bound: bound, reject: reject}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var addr string
+	if version == 4 {
+		addr, err = readSOCKS4Request(reader)
+	} else {
+		addr, err = readSOCKS5Request(reader, conn)
+	}
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	s.requested = append(s.requested, addr)
+	s.lock.Unlock()
+
+	var remote net.Conn
+	if !s.reject {
+		remote, err = net.Dial("tcp", addr)
+	}
+	ok := !s.reject && err == nil
+
+	if version == 4 {
+		code := byte(91)
+		if ok {
+			code = 90
+		}
+		conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	} else {
+		code := byte(5)
+		if ok {
+			code = 0
+		}
+		reply := append([]byte{5, code, 0}, s.bound...)
+		conn.Write(append(reply, 0x1f, 0x90))
+	}
+
+	if !ok {
+		return
+	}
+	defer remote.Close()
+
+	go io.Copy(remote, reader)
+	io.Copy(conn, remote)
+}
+
+// readSOCKS4Request reads a SOCKS4 or SOCKS4a CONNECT after the version byte and returns the address asked for
+func readSOCKS4Request(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if _, err := reader.ReadString(0); err != nil {
+		return "", err
+	}
+
+	port := binary.BigEndian.Uint16(header[1:3])
+	host := net.IP(header[3:7]).String()
+
+	// 0.0.0.x means the name follows the user ID
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		name, err := reader.ReadString(0)
+		if err != nil {
+			return "", err
+		}
+		host = name[:len(name)-1]
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readSOCKS5Request negotiates no authentication and reads a CONNECT, returning the address asked for
+func readSOCKS5Request(reader *bufio.Reader, conn net.Conn) (string, error) {
+	methods, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(reader, make([]byte, methods)); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{5, 0})
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+
+	var host []byte
+	switch header[3] {
+	case 1:
+		host = make([]byte, net.IPv4len)
+	case 4:
+		host = make([]byte, net.IPv6len)
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		host = make([]byte, length)
+	}
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", err
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	name := string(host)
+	if header[3] != 3 {
+		name = net.IP(host).String()
+	}
+
+	return net.JoinHostPort(name, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (s *socksServer) Requested() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requested...)
+}
+
+func (s *socksServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *socksServer) Close() {
+	s.listener.Close()
+}
+
+var _ = Describe("SOCKS", func() {
+	var target net.Listener
+
+	boundIPv4 := []byte{1, 10, 0, 0, 1}
+	boundIPv6 := append([]byte{4}, net.ParseIP("2001:db8::1")...)
+	boundDomain := append([]byte{3, 11}, "socks.local"...)
+
+	BeforeEach(func() {
+		target = newEchoServer()
+	})
+
+	AfterEach(func() {
+		target.Close()
+	})
+
+	// echo checks data makes the round trip through conn
+	echo := func(conn net.Conn) {
+		defer conn.Close()
+		io.WriteString(conn, "hello\n")
+		Expect(bufio.NewReader(conn).ReadString('\n')).Should(Equal("hello\n"))
+	}
+
+	// localhostAddr is the target address by name, so the proxy has to resolve it
+	localhostAddr := func() string {
+		_, port, _ := net.SplitHostPort(target.Addr().String())
+		return net.JoinHostPort("localhost", port)
+	}
+
+	Describe("SOCKS5", func() {
+		for _, bound := range []struct {
+			name string
+			addr []byte
+		}{{"IPv4", boundIPv4}, {"IPv6", boundIPv6}, {"domain", boundDomain}} {
+			bound := bound
+
+			It("should connect when the proxy replies with an "+bound.name+" bound address", func() {
+				server := newSOCKSServer(bound.addr, false)
+				defer server.Close()
+
+				conn, err := New("socks5://"+server.Addr()).ConnectDial(context.Background(), "tcp", target.Addr().String())
+				Expect(err).ShouldNot(HaveOccurred())
+				echo(conn)
+
+				Expect(server.Requested()).Should(Equal([]string{target.Addr().String()}))
+			})
+		}
+
+		It("should leave names for the proxy to resolve", func() {
+			server := newSOCKSServer(boundIPv4, false)
+			defer server.Close()
+
+			conn, err := New("socks5://"+server.Addr()).ConnectDial(context.Background(), "tcp", localhostAddr())
+			Expect(err).ShouldNot(HaveOccurred())
+			echo(conn)
+
+			Expect(server.Requested()).Should(Equal([]string{localhostAddr()}))
+		})
+
+		It("should return an error if the proxy rejects the request", func() {
+			server := newSOCKSServer(boundIPv4, true)
+			defer server.Close()
+
+			_, err := New("socks5://"+server.Addr()).ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).Should(MatchError(ContainSubstring("rejected")))
+		})
+	})
+
+	Describe("SOCKS4", func() {
+		It("should connect to an IPv4 address", func() {
+			server := newSOCKSServer(nil, false)
+			defer server.Close()
+
+			conn, err := New("socks4://"+server.Addr()).ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).ShouldNot(HaveOccurred())
+			echo(conn)
+
+			Expect(server.Requested()).Should(Equal([]string{target.Addr().String()}))
+		})
+
+		It("should leave names for the proxy to resolve with SOCKS4a", func() {
+			server := newSOCKSServer(nil, false)
+			defer server.Close()
+
+			conn, err := New("socks4://"+server.Addr()).ConnectDial(context.Background(), "tcp", localhostAddr())
+			Expect(err).ShouldNot(HaveOccurred())
+			echo(conn)
+
+			Expect(server.Requested()).Should(Equal([]string{localhostAddr()}))
+		})
+
+		It("should return an error if the proxy rejects the request", func() {
+			server := newSOCKSServer(nil, true)
+			defer server.Close()
+
+			_, err := New("socks4://"+server.Addr()).ConnectDial(context.Background(), "tcp", target.Addr().String())
+			Expect(err).Should(MatchError(ContainSubstring("rejected")))
+		})
+	})
+})
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshKeepAlive is how often idle bastion connections are checked so dead ones are replaced before they're needed
+const sshKeepAlive = 30 * time.Second
+
+// sshTransport opens direct-tcpip channels through a bastion, sharing one SSH connection between all of them.
+// The connection is made when first needed and again whenever it is lost.
+type sshTransport struct {
+	addr   string
+	config *ssh.ClientConfig
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	lock   sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+func newSSHTransport(user, addr string, config func(user, addr string) *ssh.ClientConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *sshTransport {
+	t := &sshTransport{addr: addr, dial: dial}
+	if config != nil {
+		t.config = config(user, addr)
+	}
+	return t
+}
+
+// DialContext connects to addr through the bastion
+func (t *sshTransport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, addr)
+
+	// The bastion refusing the channel is about addr; anything else means the connection is broken so try a fresh one
+	var openErr *ssh.OpenChannelError
+	if err != nil && !errors.As(err, &openErr) && ctx.Err() == nil {
+		t.drop(client)
+
+		if client, err = t.connect(ctx); err != nil {
+			return nil, err
+		}
+		conn, err = client.DialContext(ctx, network, addr)
+	}
+
+	return conn, err
+}
+
+// connect returns the connection to the bastion, making it if there is none
+func (t *sshTransport) connect(ctx context.Context) (*ssh.Client, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	if t.closed {
+		return nil, errors.New("SSH upstream is closed")
+	}
+
+	if t.config == nil {
+		return nil, errors.New("SSH upstreams are not configured")
+	}
+
+	conn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(t.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && (t.config.Timeout == 0 || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(sshConn, channels, requests)
+	t.client = client
+
+	log.WithFields(log.Fields{"bastion": t.addr, "user": t.config.User}).Info("Connected to SSH bastion")
+
+	go t.keepAlive(client)
+
+	return client, nil
+}
+
+// keepAlive pings the bastion until the connection fails and then drops it
+func (t *sshTransport) keepAlive(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(sshKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			t.drop(client)
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				t.drop(client)
+				return
+			}
+		}
+	}
+}
+
+// Close disconnects from the bastion, ending any tunnels through it, and stops new connections being made
+func (t *sshTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.client == nil {
+		return nil
+	}
+
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+// drop closes client and forgets it if it is still the current connection
+func (t *sshTransport) drop(client *ssh.Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.client != client {
+		return
+	}
+
+	log.WithFields(log.Fields{"bastion": t.addr}).Debug("Lost connection to SSH bastion")
+	client.Close()
+	t.client = nil
+}
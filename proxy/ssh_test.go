@@ -0,0 +1,309 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/mikesimons/pacyak/proxy"
+	"github.com/mikesimons/pacyak/sshconfig"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newSSHKey generates an ed25519 key
+func newSSHKey() (ssh.Signer, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	signer, err := ssh.NewSignerFromKey(key)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	return signer, key
+}
+
+// sshServer is a bastion that accepts clientKey and opens direct-tcpip channels
+type sshServer struct {
+	listener     *countingListener
+	disconnected int32
+
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func newSSHServer(hostKey ssh.Signer, clientKey ssh.PublicKey) *sshServer {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "tester" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ShouldNot(HaveOccurred())
+
+	server := &sshServer{listener: &countingListener{Listener: listener}}
+
+	go func() {
+		for {
+			conn, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+
+			go server.serve(conn, config)
+		}
+	}()
+
+	return server
+}
+
+func (s *sshServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer atomic.AddInt32(&s.disconnected, 1)
+
+	for newChannel := range channels {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+
+		go func() {
+			io.Copy(channel, remote)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(remote, channel)
+			remote.Close()
+		}()
+	}
+}
+
+func (s *sshServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *sshServer) Accepted() int32 {
+	return atomic.LoadInt32(&s.listener.accepted)
+}
+
+// Disconnected counts the SSH connections that have ended
+func (s *sshServer) Disconnected() int32 {
+	return atomic.LoadInt32(&s.disconnected)
+}
+
+// DropConnections closes every client connection as if the network went away
+func (s *sshServer) DropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServer) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+var _ = Describe("SSH", func() {
+	var dir string
+	var target net.Listener
+	var bastion *sshServer
+	var hostKey ssh.Signer
+	var identityFile string
+
+	// sshProxy returns a proxy through the bastion with known_hosts holding knownKey for it
+	sshProxy := func(knownKey ssh.PublicKey) *Proxy {
+		knownHostsFile := filepath.Join(dir, "known_hosts")
+		line := knownhosts.Line([]string{knownhosts.Normalize(bastion.Addr())}, knownKey)
+		Expect(ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600)).Should(Succeed())
+
+		config, err := sshconfig.Load(sshconfig.Opts{KnownHosts: knownHostsFile, IdentityFiles: []string{identityFile}, NoAgent: true})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		return NewWithOpts("ssh://tester@"+bastion.Addr(), &Opts{SSHConfig: config.ClientConfig})
+	}
+
+	// echo opens a tunnel to target and checks data makes the round trip
+	echo := func(proxy *Proxy) net.Conn {
+		conn, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		io.WriteString(conn, "hello\n")
+		Expect(bufio.NewReader(conn).ReadString('\n')).Should(Equal("hello\n"))
+		return conn
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pacyak-ssh")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		var clientKey ed25519.PrivateKey
+		var clientSigner ssh.Signer
+		hostKey, _ = newSSHKey()
+		clientSigner, clientKey = newSSHKey()
+
+		block, err := ssh.MarshalPrivateKey(clientKey, "")
+		Expect(err).ShouldNot(HaveOccurred())
+		identityFile = filepath.Join(dir, "id_ed25519")
+		Expect(ioutil.WriteFile(identityFile, pem.EncodeToMemory(block), 0600)).Should(Succeed())
+
+		bastion = newSSHServer(hostKey, clientSigner.PublicKey())
+		target = newEchoServer()
+	})
+
+	AfterEach(func() {
+		bastion.Close()
+		target.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should tunnel through one connection to the bastion", func() {
+		proxy := sshProxy(hostKey.PublicKey())
+
+		for i := 0; i < 3; i++ {
+			defer echo(proxy).Close()
+		}
+
+		Expect(bastion.Accepted()).Should(Equal(int32(1)))
+	})
+
+	It("should return an error if the bastion can't reach the destination", func() {
+		proxy := sshProxy(hostKey.PublicKey())
+		echo(proxy).Close()
+
+		closed, _ := net.Listen("tcp", "127.0.0.1:0")
+		closed.Close()
+
+		_, err := proxy.ConnectDial(context.Background(), "tcp", closed.Addr().String())
+		Expect(err).Should(HaveOccurred())
+		Expect(bastion.Accepted()).Should(Equal(int32(1)))
+	})
+
+	It("should reconnect when the connection to the bastion is lost", func() {
+		proxy := sshProxy(hostKey.PublicKey())
+		echo(proxy).Close()
+
+		bastion.DropConnections()
+
+		echo(proxy).Close()
+		Expect(bastion.Accepted()).Should(Equal(int32(2)))
+	})
+
+	It("should disconnect from the bastion when closed", func() {
+		proxy := sshProxy(hostKey.PublicKey())
+		echo(proxy).Close()
+
+		proxy.Close()
+		Eventually(bastion.Disconnected).Should(Equal(int32(1)))
+
+		_, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+		Expect(err).Should(HaveOccurred())
+		Expect(bastion.Accepted()).Should(Equal(int32(1)))
+	})
+
+	It("should stay connected to the bastion until tunnels open when closed have finished", func() {
+		proxy := sshProxy(hostKey.PublicKey())
+		server := httptest.NewServer(proxy)
+		defer server.Close()
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).ShouldNot(HaveOccurred())
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+target.Addr().String()+" HTTP/1.1\r\nHost: "+target.Addr().String()+"\r\n\r\n")
+		response, err := http.ReadResponse(reader, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+		proxy.Close()
+
+		io.WriteString(conn, "hello\n")
+		Expect(reader.ReadString('\n')).Should(Equal("hello\n"))
+		Consistently(bastion.Disconnected, "100ms").Should(Equal(int32(0)))
+
+		conn.Close()
+		Eventually(bastion.Disconnected).Should(Equal(int32(1)))
+	})
+
+	It("should refuse a bastion whose host key isn't known", func() {
+		otherKey, _ := newSSHKey()
+		proxy := sshProxy(otherKey.PublicKey())
+
+		_, err := proxy.ConnectDial(context.Background(), "tcp", target.Addr().String())
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should send plain HTTP requests through the bastion", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}))
+		defer origin.Close()
+
+		server := httptest.NewServer(sshProxy(hostKey.PublicKey()))
+		defer server.Close()
+
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		response, err := client.Get(origin.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer response.Body.Close()
+
+		Expect(ioutil.ReadAll(response.Body)).Should(Equal([]byte("hello")))
+	})
+})
@@ -0,0 +1,138 @@
+package proxy_test
+
+import (
+	. "github.com/mikesimons/pacyak/proxy"
+
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming", func() {
+	var server *httptest.Server
+	var client *http.Client
+
+	BeforeEach(func() {
+		server = httptest.NewServer(New("direct"))
+		proxyURL, _ := url.Parse(server.URL)
+		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should pass server-sent events on as they arrive", func() {
+		release := make(chan struct{})
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer origin.Close()
+		defer close(release)
+
+		line := readFirstLine(client, origin.URL)
+
+		Eventually(line, 2*time.Second).Should(Receive(Equal("data: first\n")))
+	})
+
+	It("should pass chunked bodies of unknown length on as they arrive", func() {
+		release := make(chan struct{})
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("line 1\n"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer origin.Close()
+		defer close(release)
+
+		line := readFirstLine(client, origin.URL)
+
+		Eventually(line, 2*time.Second).Should(Receive(Equal("line 1\n")))
+	})
+
+	It("should forward trailers", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("body"))
+			w.Header().Set("X-Checksum", "abc123")
+		}))
+		defer origin.Close()
+
+		response, err := client.Get(origin.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		Expect(string(body)).Should(Equal("body"))
+		Expect(response.Trailer.Get("X-Checksum")).Should(Equal("abc123"))
+	})
+
+	It("should cancel the upstream request when the client goes away", func() {
+		cancelled := make(chan struct{})
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			close(cancelled)
+		}))
+		defer origin.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		request, _ := http.NewRequest("GET", origin.URL, nil)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+
+		_, err := client.Do(request.WithContext(ctx))
+		Expect(err).Should(HaveOccurred())
+		Eventually(cancelled, 2*time.Second).Should(BeClosed())
+	})
+
+	It("should return a 502 when the upstream request fails", func() {
+		origin := httptest.NewServer(http.NotFoundHandler())
+		origin.Close()
+
+		response, err := client.Get(origin.URL)
+		Expect(err).ShouldNot(HaveOccurred())
+		defer response.Body.Close()
+
+		Expect(response.StatusCode).Should(Equal(http.StatusBadGateway))
+		Expect(ioutil.ReadAll(response.Body)).Should(Equal([]byte("pacyak error: unable to connect to remote host")))
+	})
+})
+
+// readFirstLine fetches u in the background and sends the first line of the body on the returned channel
+func readFirstLine(client *http.Client, u string) chan string {
+	line := make(chan string, 1)
+
+	go func() {
+		response, err := client.Get(u)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+
+		text, _ := bufio.NewReader(response.Body).ReadString('\n')
+		line <- text
+	}()
+
+	return line
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TunnelStats describes a CONNECT or upgraded tunnel once it has closed
+type TunnelStats struct {
+	Addr      string
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration
+	TimedOut  bool
+}
+
+// bufferPool holds the buffers used to copy tunnel and response bodies so each copy doesn't allocate its own
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// closeWriter is implemented by connections that can be half-closed, such as *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// activity records when a tunnel last carried data
+type activity struct {
+	last int64
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// activityWriter notes the time of every write
+type activityWriter struct {
+	io.Writer
+	activity *activity
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	w.activity.touch()
+	return w.Writer.Write(p)
+}
+
+// tunnel copies data both ways between client and remote until both directions have ended or the tunnel has been
+// idle for longer than the idle timeout. When one side stops sending the other is half-closed so it sees EOF but
+// can still reply. Both connections are closed on return.
+func (proxy *Proxy) tunnel(addr string, client io.ReadWriteCloser, remote io.ReadWriteCloser) TunnelStats {
+	stats := TunnelStats{Addr: addr}
+	start := time.Now()
+
+	// Activity is only tracked when it matters as it keeps TCP tunnels off the kernel's splice(2) path
+	var active *activity
+	if proxy.opts.IdleTimeout > 0 {
+		active = &activity{}
+		active.touch()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stats.BytesUp = pipe(remote, client, active)
+	}()
+	go func() {
+		defer wg.Done()
+		stats.BytesDown = pipe(client, remote, active)
+	}()
+
+	done := make(chan struct{})
+	var timedOut int32
+	if proxy.opts.IdleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(proxy.opts.IdleTimeout / 4)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if active.idleFor() >= proxy.opts.IdleTimeout {
+						atomic.StoreInt32(&timedOut, 1)
+						client.Close()
+						remote.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	client.Close()
+	remote.Close()
+
+	stats.Duration = time.Since(start)
+	stats.TimedOut = atomic.LoadInt32(&timedOut) == 1
+
+	log.WithFields(log.Fields{
+		"addr":       stats.Addr,
+		"bytes_up":   stats.BytesUp,
+		"bytes_down": stats.BytesDown,
+		"duration":   stats.Duration,
+		"timed_out":  stats.TimedOut,
+	}).Debug("Tunnel closed")
+
+	return stats
+}
+
+// pipe copies src to dst until src ends and then half-closes dst, or closes it if it can't be half-closed
+// Errors are expected here (peers reset connections at will) so they are not reported
+func pipe(dst io.ReadWriteCloser, src io.Reader, active *activity) int64 {
+	n := copyData(dst, src, active)
+
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+
+	return n
+}
+
+// copyData copies src to dst as cheaply as it can. Hijacked connections are unwrapped once their buffered data has
+// been sent so that, when active is nil, raw TCP sockets are copied by the kernel with splice(2) on Linux. Otherwise
+// a pooled buffer is used and every write is noted in active.
+func copyData(dst io.Writer, src io.Reader, active *activity) int64 {
+	var written int64
+
+	if conn, ok := src.(*bufferedConn); ok {
+		if buffered := conn.reader.Buffered(); buffered > 0 {
+			n, err := io.CopyN(trackActivity(dst, active), conn.reader, int64(buffered))
+			written += n
+			if err != nil {
+				return written
+			}
+		}
+		src = conn.Conn
+	}
+
+	if conn, ok := dst.(*bufferedConn); ok {
+		dst = conn.Conn
+	}
+
+	if active == nil {
+		_, dstTCP := dst.(*net.TCPConn)
+		_, srcTCP := src.(*net.TCPConn)
+		if dstTCP && srcTCP {
+			n, _ := io.Copy(dst, src)
+			return written + n
+		}
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
+	// readerOnly and writerOnly hide any WriteTo and ReadFrom methods. They would bypass the activity tracking and,
+	// as a *net.TCPConn can't splice from a wrapped conn, copy through a buffer of their own instead of ours.
+	n, _ := io.CopyBuffer(writerOnly{trackActivity(dst, active)}, readerOnly{src}, *buf)
+	return written + n
+}
+
+// trackActivity returns dst wrapped to note writes in active, or dst itself if active is nil
+func trackActivity(dst io.Writer, active *activity) io.Writer {
+	if active == nil {
+		return dst
+	}
+	return &activityWriter{Writer: dst, activity: active}
+}
+
+// readerOnly exposes only the Read method of a reader
+type readerOnly struct {
+	io.Reader
+}
+
+// writerOnly exposes only the Write method of a writer
+type writerOnly struct {
+	io.Writer
+}
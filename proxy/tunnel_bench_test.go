@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+const benchmarkPayload = 8 * 1024 * 1024
+
+// wrappedConn hides the concrete conn type as TLS and hijacked conns do
+type wrappedConn struct {
+	net.Conn
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(b *testing.B) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return dialed, <-accepted
+}
+
+// benchmarkCopy sends benchmarkPayload through copy from one TCP connection to another per iteration.
+// wrapSrc and wrapDst hide the TCP connection read from and written to, as TLS does.
+func benchmarkCopy(b *testing.B, wrapSrc bool, wrapDst bool, copy func(dst io.Writer, src io.Reader) int64) {
+	payload := make([]byte, benchmarkPayload)
+
+	b.SetBytes(benchmarkPayload)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender, src := tcpPair(b)
+		dst, receiver := tcpPair(b)
+		b.StartTimer()
+
+		go func() {
+			sender.Write(payload)
+			sender.Close()
+		}()
+
+		done := make(chan int64)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, receiver)
+			done <- n
+		}()
+
+		var from io.Reader = src
+		var to io.Writer = dst
+		if wrapSrc {
+			from = wrappedConn{src}
+		}
+		if wrapDst {
+			to = wrappedConn{dst}
+		}
+
+		copy(to, from)
+		dst.Close()
+
+		if n := <-done; n != benchmarkPayload {
+			b.Fatalf("copied %d bytes, expected %d", n, benchmarkPayload)
+		}
+
+		src.Close()
+		receiver.Close()
+	}
+}
+
+// legacyCopy is the tunnel copy as it was before pooling
+func legacyCopy(dst io.Writer, src io.Reader) int64 {
+	n, _ := io.Copy(dst, src)
+	return n
+}
+
+func pooledCopy(dst io.Writer, src io.Reader) int64 {
+	return copyData(dst, src, nil)
+}
+
+// trackedCopy is the copy used when tunnels have an idle timeout
+func trackedCopy(dst io.Writer, src io.Reader) int64 {
+	return copyData(dst, src, &activity{})
+}
+
+func BenchmarkTunnelTCPLegacy(b *testing.B)        { benchmarkCopy(b, false, false, legacyCopy) }
+func BenchmarkTunnelTCP(b *testing.B)              { benchmarkCopy(b, false, false, pooledCopy) }
+func BenchmarkTunnelTCPTracked(b *testing.B)       { benchmarkCopy(b, false, false, trackedCopy) }
+func BenchmarkTunnelWrappedLegacy(b *testing.B)    { benchmarkCopy(b, true, true, legacyCopy) }
+func BenchmarkTunnelWrapped(b *testing.B)          { benchmarkCopy(b, true, true, pooledCopy) }
+func BenchmarkTunnelWrappedSrcLegacy(b *testing.B) { benchmarkCopy(b, true, false, legacyCopy) }
+func BenchmarkTunnelWrappedSrc(b *testing.B)       { benchmarkCopy(b, true, false, pooledCopy) }
@@ -0,0 +1,172 @@
+package proxy_test
+
+import (
+	. "github.com/mikesimons/pacyak/proxy"
+
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// tunnelHook records tunnel close log entries
+type tunnelHook struct {
+	entries []*log.Entry
+	lock    sync.Mutex
+}
+
+func (h *tunnelHook) Levels() []log.Level { return []log.Level{log.DebugLevel} }
+
+func (h *tunnelHook) Fire(entry *log.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if entry.Message == "Tunnel closed" {
+		h.entries = append(h.entries, entry)
+	}
+	return nil
+}
+
+func (h *tunnelHook) closed() []*log.Entry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]*log.Entry(nil), h.entries...)
+}
+
+var _ = Describe("Tunnel", func() {
+	var target net.Listener
+	var server *httptest.Server
+
+	// serve accepts connections on target and hands them to handler
+	serve := func(handler func(net.Conn)) {
+		var err error
+		target, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		go func() {
+			for {
+				conn, err := target.Accept()
+				if err != nil {
+					return
+				}
+				go handler(conn)
+			}
+		}()
+	}
+
+	// connect opens a tunnel to target, sending extra immediately after the CONNECT request
+	connect := func(extra string) (*net.TCPConn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		addr := target.Addr().String()
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n"+extra)
+
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(response.StatusCode).Should(Equal(http.StatusOK))
+
+		return conn.(*net.TCPConn), reader
+	}
+
+	AfterEach(func() {
+		server.Close()
+		target.Close()
+	})
+
+	Context("with default options", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(New("direct"))
+		})
+
+		It("should forward data the client sent straight after the CONNECT", func() {
+			serve(func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			})
+
+			conn, reader := connect("pipelined\n")
+			defer conn.Close()
+
+			Expect(reader.ReadString('\n')).Should(Equal("pipelined\n"))
+		})
+
+		It("should half-close so the remote can still reply after the client finishes sending", func() {
+			serve(func(conn net.Conn) {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				time.Sleep(50 * time.Millisecond)
+				fmt.Fprintf(conn, "got %d bytes", len(data))
+			})
+
+			conn, reader := connect("")
+			defer conn.Close()
+
+			io.WriteString(conn, "hello")
+			conn.CloseWrite()
+
+			Expect(ioutil.ReadAll(reader)).Should(Equal([]byte("got 5 bytes")))
+		})
+
+		It("should report bytes transferred when the tunnel closes", func() {
+			hook := &tunnelHook{}
+			level := log.GetLevel()
+			log.SetLevel(log.DebugLevel)
+			log.AddHook(hook)
+			defer func() {
+				log.SetLevel(level)
+				log.StandardLogger().Hooks = make(log.LevelHooks)
+			}()
+
+			serve(func(conn net.Conn) {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+				io.WriteString(conn, "0123456789")
+			})
+
+			conn, reader := connect("abc")
+			conn.CloseWrite()
+			ioutil.ReadAll(reader)
+			conn.Close()
+
+			Eventually(hook.closed).Should(HaveLen(1))
+			entry := hook.closed()[0]
+			Expect(entry.Data["bytes_up"]).Should(BeEquivalentTo(3))
+			Expect(entry.Data["bytes_down"]).Should(BeEquivalentTo(10))
+		})
+	})
+
+	Context("with an idle timeout", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(NewWithOpts("direct", &Opts{IdleTimeout: 100 * time.Millisecond}))
+		})
+
+		It("should close idle tunnels", func() {
+			serve(func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			})
+
+			conn, reader := connect("")
+			defer conn.Close()
+
+			closed := make(chan error, 1)
+			go func() {
+				_, err := reader.ReadByte()
+				closed <- err
+			}()
+
+			Eventually(closed, 2*time.Second).Should(Receive(Equal(io.EOF)))
+		})
+	})
+})
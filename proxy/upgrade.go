@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// upgradeType returns the protocol a request asks to upgrade to (e.g. "websocket") or "" if it isn't an upgrade
+func upgradeType(header http.Header) string {
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+
+	return ""
+}
+
+// serveUpgrade performs an HTTP Upgrade (e.g. WebSocket) upstream and splices the client and upstream connections
+// together as CONNECT does. If upstream declines the upgrade its response is passed on as normal.
+func (proxy *Proxy) serveUpgrade(response http.ResponseWriter, request *http.Request) {
+	protocol := upgradeType(request.Header)
+
+	// Connection and Upgrade are hop-by-hop but for an upgrade they must go to the next hop too
+	proxy.filterRequestHeaders(request)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", protocol)
+
+	// http.Transport only speaks http and https; WebSocket URLs are the same requests by another name
+	switch request.URL.Scheme {
+	case "ws":
+		request.URL.Scheme = "http"
+	case "wss":
+		request.URL.Scheme = "https"
+	}
+
+	upstreamResponse, ok := proxy.makeUpstreamRequest(request)
+	if !ok {
+		response.WriteHeader(502)
+		response.Write([]byte("pacyak error: unable to connect to remote host"))
+		return
+	}
+
+	if upstreamResponse.StatusCode != http.StatusSwitchingProtocols {
+		proxy.copyResponse(upstreamResponse, response)
+		return
+	}
+
+	upstreamConn, ok := upstreamResponse.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(upgradeType(upstreamResponse.Header), protocol) {
+		log.WithFields(log.Fields{"url": request.URL.String(), "protocol": protocol}).Error("Upstream switched to an unexpected protocol")
+		upstreamResponse.Body.Close()
+		response.WriteHeader(502)
+		response.Write([]byte("pacyak error: upstream switched to an unexpected protocol"))
+		return
+	}
+
+	client, ok := proxy.hijack(response)
+	if !ok {
+		upstreamConn.Close()
+		return
+	}
+
+	removeHopByHopHeaders(upstreamResponse.Header)
+	upstreamResponse.Header.Set("Connection", "Upgrade")
+	upstreamResponse.Header.Set("Upgrade", protocol)
+	if proxy.opts.Via {
+		addVia(upstreamResponse.Header, upstreamResponse.ProtoMajor, upstreamResponse.ProtoMinor)
+	}
+
+	fmt.Fprintf(client, "HTTP/1.1 101 Switching Protocols\r\n")
+	upstreamResponse.Header.Write(client)
+	io.WriteString(client, "\r\n")
+
+	log.WithFields(log.Fields{"url": request.URL.String(), "protocol": protocol}).Debug("Upgraded connection")
+
+	proxy.tunnel(request.URL.Host, client, upstreamConn)
+}
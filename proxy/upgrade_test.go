@@ -0,0 +1,89 @@
+package proxy_test
+
+import (
+	. "github.com/mikesimons/pacyak/proxy"
+
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// echoUpgradeHandler upgrades requests for the "echo" protocol and then echoes whatever it is sent
+func echoUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+		http.Error(w, "upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	io.Copy(conn, buffered)
+}
+
+var _ = Describe("Upgrade", func() {
+	var origin *httptest.Server
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(echoUpgradeHandler))
+		server = httptest.NewServer(New("direct"))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		origin.Close()
+	})
+
+	// upgrade sends an upgrade request for target through the proxy and returns the connection and response
+	upgrade := func(target string, headers string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		Expect(err).ShouldNot(HaveOccurred())
+
+		host := strings.TrimPrefix(origin.URL, "http://")
+		io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: "+host+"\r\n"+headers+"\r\n")
+
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		return conn, reader, response
+	}
+
+	It("should upgrade the connection and splice it to upstream", func() {
+		conn, reader, response := upgrade(origin.URL+"/", "Connection: Upgrade\r\nUpgrade: echo\r\n")
+		defer conn.Close()
+
+		Expect(response.StatusCode).Should(Equal(http.StatusSwitchingProtocols))
+		Expect(response.Header.Get("Upgrade")).Should(Equal("echo"))
+
+		io.WriteString(conn, "ping\n")
+		Expect(reader.ReadString('\n')).Should(Equal("ping\n"))
+	})
+
+	It("should accept ws:// URLs", func() {
+		conn, reader, response := upgrade(strings.Replace(origin.URL, "http://", "ws://", 1)+"/", "Connection: keep-alive, Upgrade\r\nUpgrade: echo\r\n")
+		defer conn.Close()
+
+		Expect(response.StatusCode).Should(Equal(http.StatusSwitchingProtocols))
+
+		io.WriteString(conn, "pong\n")
+		Expect(reader.ReadString('\n')).Should(Equal("pong\n"))
+	})
+
+	It("should pass on the response if upstream declines the upgrade", func() {
+		conn, _, response := upgrade(origin.URL+"/", "Connection: Upgrade\r\nUpgrade: something-else\r\n")
+		defer conn.Close()
+
+		Expect(response.StatusCode).Should(Equal(http.StatusBadRequest))
+	})
+})
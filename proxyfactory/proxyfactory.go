@@ -1,6 +1,7 @@
 package proxyfactory
 
 import (
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -13,7 +14,11 @@ import (
 type ProxyFactory struct {
 	proxies      map[string]*proxy.Proxy
 	availability map[string]bool
+	defaultOpts  proxy.Opts
+	upstreamOpts map[string]proxy.Opts
 	lock         *sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
 }
 
 // New is the constructor function for ProxyFactory
@@ -22,27 +27,76 @@ func New() *ProxyFactory {
 		proxies:      make(map[string]*proxy.Proxy),
 		availability: make(map[string]bool),
 		lock:         &sync.Mutex{},
+		done:         make(chan struct{}),
 	}
 
-	go func() {
-		for _ = range time.Tick(30 * time.Second) {
-			pf.lock.Lock()
-			for key, proxy := range pf.proxies {
-				pf.availability[key] = proxy.Available()
+	go pf.monitorAvailability(30 * time.Second)
 
-				log.WithFields(log.Fields{
-					"proxy":     key,
-					"available": pf.availability[key],
-				}).Debug("Proxy availability check")
-			}
-			pf.lock.Unlock()
+	return pf
+}
+
+// Close stops the availability checks and closes the proxies made so far. The factory must not be used afterwards.
+func (pf *ProxyFactory) Close() {
+	pf.closeOnce.Do(func() { close(pf.done) })
+
+	pf.lock.Lock()
+	proxies := pf.proxies
+	pf.proxies = make(map[string]*proxy.Proxy)
+	pf.lock.Unlock()
+
+	closeProxies(proxies)
+}
+
+// closeProxies closes proxies that are no longer handed out
+func closeProxies(proxies map[string]*proxy.Proxy) {
+	for _, proxy := range proxies {
+		proxy.Close()
+	}
+}
+
+// monitorAvailability checks every proxy each interval until the factory is closed
+func (pf *ProxyFactory) monitorAvailability(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pf.done:
+			return
+		case <-ticker.C:
+			pf.checkAvailability()
 		}
-	}()
+	}
+}
 
-	return pf
+// checkAvailability pings every proxy. The lock isn't held while pinging as a check can take a while.
+func (pf *ProxyFactory) checkAvailability() {
+	pf.lock.Lock()
+	proxies := make(map[string]*proxy.Proxy, len(pf.proxies))
+	for key, proxy := range pf.proxies {
+		proxies[key] = proxy
+	}
+	pf.lock.Unlock()
+
+	for key, proxy := range proxies {
+		available := proxy.Available()
+
+		pf.lock.Lock()
+		// The proxy may have been replaced by SetOpts meanwhile
+		if pf.proxies[key] == proxy {
+			pf.availability[key] = available
+		}
+		pf.lock.Unlock()
+
+		log.WithFields(log.Fields{
+			"proxy":     key,
+			"available": available,
+		}).Debug("Proxy availability check")
+	}
 }
 
-func (pf *ProxyFactory) available(handle string) bool {
+// Available reports whether the proxy with the given handle passed its last availability check
+func (pf *ProxyFactory) Available(handle string) bool {
 	pf.lock.Lock()
 	defer func() {
 		pf.lock.Unlock()
@@ -59,38 +113,155 @@ func (pf *ProxyFactory) available(handle string) bool {
 // If one already exists with the given handle, it will be used.
 // Otherwise a new one will be created.
 func (pf *ProxyFactory) Proxy(handle string) *proxy.Proxy {
-	var ret *proxy.Proxy
+	return pf.ProxyWithBinding(handle, proxy.Binding{})
+}
+
+// ProxyWithBinding is Proxy with connections bound to an interface or source address instead of the upstream's
+func (pf *ProxyFactory) ProxyWithBinding(handle string, binding proxy.Binding) *proxy.Proxy {
+	key := cacheKey(handle, binding)
 
 	pf.lock.Lock()
-	if _, ok := pf.proxies[handle]; !ok {
-		proxy := proxy.New(handle)
-		pf.availability[handle] = proxy.Available()
-		pf.proxies[handle] = proxy
+	defer pf.lock.Unlock()
+
+	if _, ok := pf.proxies[key]; !ok {
+		opts := pf.optsFor(handle)
+		if !binding.IsZero() {
+			opts.Bind = binding
+		}
+
+		proxy := proxy.NewWithOpts(handle, opts)
+		pf.availability[key] = proxy.Available()
+		pf.proxies[key] = proxy
+	}
+
+	return pf.proxies[key]
+}
+
+// cacheKey identifies the proxy for handle with binding
+func cacheKey(handle string, binding proxy.Binding) string {
+	if binding.IsZero() {
+		return handle
 	}
-	ret = pf.proxies[handle]
+	return handle + " " + binding.String()
+}
+
+// SetOpts sets the options used for new proxies: defaults for all, overridden per upstream by host:port.
+// Proxies already made are dropped so they are rebuilt with the new options; each is closed once the requests it is
+// serving have finished.
+func (pf *ProxyFactory) SetOpts(defaults proxy.Opts, upstreams map[string]proxy.Opts) {
+	pf.lock.Lock()
+	dropped := pf.proxies
+	pf.defaultOpts = defaults
+	pf.upstreamOpts = upstreams
+	pf.proxies = make(map[string]*proxy.Proxy)
+	pf.availability = make(map[string]bool)
 	pf.lock.Unlock()
 
-	return ret
+	closeProxies(dropped)
+}
+
+// optsFor returns the options for the proxy with the given handle; pf.lock must be held
+func (pf *ProxyFactory) optsFor(handle string) *proxy.Opts {
+	host := handle
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	// Upstreams are keyed by host:port alone, so ssh://user@host:port matches its bastion
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+
+	if opts, ok := pf.upstreamOpts[host]; ok {
+		return &opts
+	}
+
+	opts := pf.defaultOpts
+	return &opts
+}
+
+// PacEntry is a single route from a PAC response such as "PROXY proxy.corp:8080".
+// For BLOCK entries Host holds the reason given, if any.
+type PacEntry struct {
+	Type string
+	Host string
+}
+
+// Handle returns the proxy handle for the entry as understood by Proxy. BLOCK entries have no proxy; callers must
+// stop at them rather than ask for one.
+func (e PacEntry) Handle() string {
+	switch e.Type {
+	case "PROXY", "HTTP":
+		return e.Host
+	case "HTTPS":
+		if _, _, err := net.SplitHostPort(e.Host); err != nil {
+			return "https://" + net.JoinHostPort(e.Host, "443")
+		}
+		return "https://" + e.Host
+	case "SOCKS", "SOCKS4":
+		return "socks4://" + e.Host
+	case "SOCKS5":
+		return "socks5://" + e.Host
+	case "SSH":
+		return "ssh://" + e.Host
+	}
+
+	return "direct"
+}
+
+// ParsePacResponse splits a PAC response string into its entries
+// Entries of a type we do not support are dropped; BLOCK entries are kept so the route stops there
+func ParsePacResponse(response string) []PacEntry {
+	var entries []PacEntry
+	for _, part := range strings.Split(response, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := PacEntry{Type: strings.ToUpper(fields[0])}
+		if len(fields) > 1 {
+			entry.Host = fields[1]
+		}
+
+		switch entry.Type {
+		case "DIRECT":
+			entries = append(entries, entry)
+		case "BLOCK":
+			entry.Host = strings.Join(fields[1:], " ")
+			entries = append(entries, entry)
+		case "PROXY", "HTTP", "HTTPS", "SOCKS", "SOCKS4", "SOCKS5", "SSH":
+			if entry.Host != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries
 }
 
 // FromPacResponse takes a PAC response string and returns a proxy
+// The first entry that is DIRECT or an available proxy is used. If there is none we go direct.
+// It returns nil if a BLOCK entry is reached first.
 func (pf *ProxyFactory) FromPacResponse(response string) *proxy.Proxy {
-	if response == "DIRECT" {
-		return pf.Proxy("direct")
-	}
+	return pf.FromPacResponseWithBinding(response, proxy.Binding{})
+}
+
+// FromPacResponseWithBinding is FromPacResponse with connections bound to an interface or source address
+func (pf *ProxyFactory) FromPacResponseWithBinding(response string, binding proxy.Binding) *proxy.Proxy {
+	for _, entry := range ParsePacResponse(response) {
+		if entry.Type == "BLOCK" {
+			return nil
+		}
 
-	response = strings.Replace(response, "PROXY", "", -1)
-	response = strings.Replace(response, " ", "", -1)
-	proxies := strings.Split(response, ";")
-	for _, proxyStr := range proxies {
-		proxy := pf.Proxy(proxyStr)
+		handle := entry.Handle()
+		proxy := pf.ProxyWithBinding(handle, binding)
 
-		if !pf.available(proxyStr) {
+		if !pf.Available(cacheKey(handle, binding)) {
 			continue
 		}
 
 		return proxy
 	}
 
-	return pf.Proxy("direct")
+	return pf.ProxyWithBinding("direct", binding)
 }
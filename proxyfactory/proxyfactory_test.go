@@ -3,8 +3,13 @@ package proxyfactory_test
 import (
 	. "github.com/mikesimons/pacyak/proxyfactory"
 
+	"github.com/mikesimons/pacyak/proxy"
+	"golang.org/x/crypto/ssh"
+
+	"context"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 
 	"github.com/elazarl/goproxy"
@@ -48,16 +53,109 @@ var _ = Describe("Proxyfactory", func() {
 		})
 	})
 
+	Describe("SetOpts", func() {
+		It("should match the upstream options of an SSH bastion without its user", func() {
+			var configured []string
+			upstreams := map[string]proxy.Opts{
+				"bastion.example:22": {SSHConfig: func(user, addr string) *ssh.ClientConfig {
+					configured = append(configured, user+" "+addr)
+					return &ssh.ClientConfig{}
+				}},
+			}
+
+			it := New()
+			defer it.Close()
+			it.SetOpts(proxy.Opts{}, upstreams)
+			it.Proxy("ssh://me@bastion.example:22")
+
+			Expect(configured).Should(Equal([]string{"me bastion.example:22"}))
+		})
+
+		It("should close the proxies it drops", func() {
+			closed := make(chan struct{}, 1)
+			origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					closed <- struct{}{}
+				}
+			}
+			origin.Start()
+			defer origin.Close()
+
+			it := New()
+			defer it.Close()
+
+			response, err := (&http.Client{Transport: it.Proxy("direct").Tr}).Get(origin.URL)
+			Expect(err).ShouldNot(HaveOccurred())
+			response.Body.Close()
+			Consistently(closed).ShouldNot(Receive())
+
+			it.SetOpts(proxy.Opts{}, nil)
+			Eventually(closed).Should(Receive())
+		})
+	})
+
+	Describe("ParsePacResponse", func() {
+		It("should split a PAC response into entries", func() {
+			Expect(ParsePacResponse("PROXY a.proxy:8080; HTTPS c.proxy:443; SOCKS5 b.proxy:1080;DIRECT")).Should(Equal([]PacEntry{
+				{Type: "PROXY", Host: "a.proxy:8080"},
+				{Type: "HTTPS", Host: "c.proxy:443"},
+				{Type: "SOCKS5", Host: "b.proxy:1080"},
+				{Type: "DIRECT"},
+			}))
+		})
+
+		It("should keep BLOCK entries with their reason", func() {
+			Expect(ParsePacResponse("PROXY a.proxy:8080; BLOCK ads and tracking")).Should(Equal([]PacEntry{
+				{Type: "PROXY", Host: "a.proxy:8080"},
+				{Type: "BLOCK", Host: "ads and tracking"},
+			}))
+			Expect(ParsePacResponse("BLOCK")).Should(Equal([]PacEntry{{Type: "BLOCK"}}))
+		})
+
+		It("should drop unsupported and malformed entries", func() {
+			Expect(ParsePacResponse("QUIC a.proxy:443; PROXY; ; DIRECT")).Should(Equal([]PacEntry{{Type: "DIRECT"}}))
+		})
+
+		It("should map entries to proxy handles", func() {
+			Expect(PacEntry{Type: "PROXY", Host: "a.proxy:8080"}.Handle()).Should(Equal("a.proxy:8080"))
+			Expect(PacEntry{Type: "HTTPS", Host: "a.proxy:8443"}.Handle()).Should(Equal("https://a.proxy:8443"))
+			Expect(PacEntry{Type: "HTTPS", Host: "a.proxy"}.Handle()).Should(Equal("https://a.proxy:443"))
+			Expect(PacEntry{Type: "SOCKS", Host: "b.proxy:1080"}.Handle()).Should(Equal("socks4://b.proxy:1080"))
+			Expect(PacEntry{Type: "SOCKS5", Host: "b.proxy:1080"}.Handle()).Should(Equal("socks5://b.proxy:1080"))
+			Expect(PacEntry{Type: "SSH", Host: "me@bastion:22"}.Handle()).Should(Equal("ssh://me@bastion:22"))
+			Expect(PacEntry{Type: "DIRECT"}.Handle()).Should(Equal("direct"))
+		})
+	})
+
+	Describe("FromPacResponseWithBinding", func() {
+		It("should keep a proxy for each binding", func() {
+			factory := New()
+			tun := proxy.Binding{Interface: "tun0"}
+
+			Expect(factory.FromPacResponseWithBinding("DIRECT", tun)).Should(BeIdenticalTo(factory.FromPacResponseWithBinding("DIRECT", tun)))
+			Expect(factory.FromPacResponseWithBinding("DIRECT", tun)).ShouldNot(BeIdenticalTo(factory.FromPacResponse("DIRECT")))
+		})
+	})
+
 	Describe("FromPacResponse", func() {
 		It("should return a direct proxy if response is DIRECT", func() {
 			factory := New()
 			proxy := factory.FromPacResponse("DIRECT")
 			var nilURL *url.URL
-			var nilDial func(string, string) (net.Conn, error)
+			var nilDial func(context.Context, string, string) (net.Conn, error)
 			Expect(proxy.Tr.Proxy(&http.Request{})).Should(Equal(nilURL))
 			Expect(proxy.ConnectDial).Should(Equal(nilDial))
 		})
 
+		It("should return nil if the response is BLOCK", func() {
+			Expect(New().FromPacResponse("BLOCK telemetry")).Should(BeNil())
+		})
+
+		It("should return nil rather than go direct when it reaches BLOCK", func() {
+			Expect(New().FromPacResponse("PROXY unavailable.invalid:8080; BLOCK")).Should(BeNil())
+		})
+
 		It("should return first proxy that is available", func() {
 		})
 
@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the cache; expired entries are dropped when it fills
+const maxCacheEntries = 4096
+
+// Cache remembers lookups for a fixed time. Names that don't exist are cached too.
+// When a lookup fails for any other reason the last answer is used, however old, so a flaky DNS server doesn't
+// cut off hosts that were reachable a moment ago.
+type Cache struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+// NewCache caches the lookups of resolver for ttl
+func NewCache(resolver Resolver, ttl time.Duration) *Cache {
+	return &Cache{resolver: resolver, ttl: ttl, entries: make(map[string]*cacheEntry)}
+}
+
+// LookupHost returns the cached addresses of host, looking it up if there are none or they have expired
+func (c *Cache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	key := normalise(host)
+	now := time.Now()
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil && !isNotFound(err) {
+		if ok && entry.err == nil {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if len(c.entries) >= maxCacheEntries {
+		c.expire(now)
+	}
+	c.entries[key] = &cacheEntry{addrs: addrs, err: err, expires: now.Add(c.ttl)}
+	c.lock.Unlock()
+
+	return addrs, err
+}
+
+// expire drops expired entries, or everything if none have expired. The lock must be held.
+func (c *Cache) expire(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]*cacheEntry)
+	}
+}
+
+// isNotFound reports whether err says the name doesn't exist rather than that the lookup failed
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
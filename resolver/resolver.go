@@ -0,0 +1,52 @@
+/*
+Package resolver provides the DNS resolvers used by pacyak.
+
+Anything with a LookupHost method taking a context can be used, including *net.Resolver.
+New returns the system resolver, NewServers builds one that queries specific DNS servers and Static is an
+in-memory resolver for tests.
+NewWithOpts builds a split-horizon resolver: names under particular domains go to their own servers, which can be
+DNS-over-TLS or DNS-over-HTTPS, some names can be pinned to addresses and answers are cached.
+*/
+package resolver
+
+import (
+	"context"
+	"net"
+)
+
+// Resolver looks up the addresses of a host; *net.Resolver satisfies it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// New returns the system resolver. Use NewServers to query particular DNS servers.
+func New() Resolver {
+	return net.DefaultResolver
+}
+
+// Static is an in-memory resolver mapping host names to addresses. Unknown hosts are not found.
+type Static map[string][]string
+
+// LookupHost returns the addresses for host
+func (s Static) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := s[host]; ok && len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// PreferIPv4 returns the first IPv4 address in addrs, or the first address if there are none
+func PreferIPv4(addrs []string) string {
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+
+	return ""
+}
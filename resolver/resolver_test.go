@@ -0,0 +1,266 @@
+package resolver_test
+
+import (
+	. "github.com/mikesimons/pacyak/resolver"
+
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// answer replies to a DNS query with an A record of ip for every A question
+func answer(query []byte, ip [4]byte) []byte {
+	var msg dnsmessage.Message
+	Expect(msg.Unpack(query)).Should(Succeed())
+
+	msg.Header.Response = true
+	for _, q := range msg.Questions {
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: ip},
+			})
+		}
+	}
+
+	packed, err := msg.Pack()
+	Expect(err).ShouldNot(HaveOccurred())
+	return packed
+}
+
+// counting counts the lookups passed to a resolver and can make them fail
+type counting struct {
+	resolver Resolver
+	lookups  int32
+	fail     error
+}
+
+func (c *counting) LookupHost(ctx context.Context, host string) ([]string, error) {
+	atomic.AddInt32(&c.lookups, 1)
+	if c.fail != nil {
+		return nil, c.fail
+	}
+	return c.resolver.LookupHost(ctx, host)
+}
+
+var _ = Describe("Resolver", func() {
+	Describe("New", func() {
+		It("should return the system resolver", func() {
+			Expect(New()).Should(Equal(net.DefaultResolver))
+		})
+	})
+
+	Describe("NewServers", func() {
+		It("should use the system resolver when no servers are given", func() {
+			Expect(NewServers(nil, nil)).Should(Equal(net.DefaultResolver))
+		})
+
+		It("should return a resolver for the given servers", func() {
+			Expect(NewServers([]string{"10.0.0.53", "10.0.0.54:5353"}, nil)).Should(BeAssignableToTypeOf(&net.Resolver{}))
+		})
+	})
+
+	Describe("Static", func() {
+		It("should resolve known hosts", func() {
+			it := Static{"proxy.corp": {"10.0.0.1"}}
+			Expect(it.LookupHost(context.Background(), "proxy.corp")).Should(Equal([]string{"10.0.0.1"}))
+		})
+
+		It("should return not found for unknown hosts", func() {
+			_, err := Static{}.LookupHost(context.Background(), "blah.blah.gobble")
+			Expect(err).Should(HaveOccurred())
+			Expect(err.(*net.DNSError).IsNotFound).Should(BeTrue())
+		})
+	})
+
+	Describe("PreferIPv4", func() {
+		It("should prefer IPv4 addresses", func() {
+			Expect(PreferIPv4([]string{"2001:4860:4860::8888", "8.8.8.8"})).Should(Equal("8.8.8.8"))
+		})
+
+		It("should fall back to the first address", func() {
+			Expect(PreferIPv4([]string{"2001:4860:4860::8888"})).Should(Equal("2001:4860:4860::8888"))
+			Expect(PreferIPv4(nil)).Should(Equal(""))
+		})
+	})
+
+	Describe("Split", func() {
+		it := &Split{
+			Domains: map[string]Resolver{
+				"corp.example":     Static{"a.corp.example": {"10.0.0.1"}, "corp.example": {"10.0.0.2"}},
+				"lab.corp.example": Static{"x.lab.corp.example": {"10.9.0.1"}},
+			},
+			Default: Static{"a.corp.example": {"192.0.2.1"}, "example.com": {"192.0.2.2"}},
+		}
+
+		It("should use the resolver for the domain of the name", func() {
+			Expect(it.LookupHost(context.Background(), "a.corp.example")).Should(Equal([]string{"10.0.0.1"}))
+			Expect(it.LookupHost(context.Background(), "corp.example")).Should(Equal([]string{"10.0.0.2"}))
+		})
+
+		It("should prefer the longest matching domain", func() {
+			Expect(it.LookupHost(context.Background(), "x.lab.corp.example")).Should(Equal([]string{"10.9.0.1"}))
+		})
+
+		It("should use the default for other names", func() {
+			Expect(it.LookupHost(context.Background(), "example.com")).Should(Equal([]string{"192.0.2.2"}))
+			_, err := it.LookupHost(context.Background(), "notcorp.example")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Cache", func() {
+		It("should cache answers until they expire", func() {
+			upstream := &counting{resolver: Static{"proxy.corp": {"10.0.0.1"}}}
+			cache := NewCache(upstream, 50*time.Millisecond)
+
+			for i := 0; i < 3; i++ {
+				Expect(cache.LookupHost(context.Background(), "proxy.corp")).Should(Equal([]string{"10.0.0.1"}))
+			}
+			Expect(atomic.LoadInt32(&upstream.lookups)).Should(Equal(int32(1)))
+
+			time.Sleep(60 * time.Millisecond)
+			cache.LookupHost(context.Background(), "proxy.corp")
+			Expect(atomic.LoadInt32(&upstream.lookups)).Should(Equal(int32(2)))
+		})
+
+		It("should cache names that don't exist", func() {
+			upstream := &counting{resolver: Static{}}
+			cache := NewCache(upstream, time.Minute)
+
+			for i := 0; i < 2; i++ {
+				_, err := cache.LookupHost(context.Background(), "blah.blah.gobble")
+				Expect(err.(*net.DNSError).IsNotFound).Should(BeTrue())
+			}
+			Expect(atomic.LoadInt32(&upstream.lookups)).Should(Equal(int32(1)))
+		})
+
+		It("should keep answering with expired addresses while lookups fail", func() {
+			upstream := &counting{resolver: Static{"proxy.corp": {"10.0.0.1"}}}
+			cache := NewCache(upstream, time.Nanosecond)
+			cache.LookupHost(context.Background(), "proxy.corp")
+
+			upstream.fail = &net.DNSError{Err: "server misbehaving", Name: "proxy.corp", IsTemporary: true}
+			Expect(cache.LookupHost(context.Background(), "proxy.corp")).Should(Equal([]string{"10.0.0.1"}))
+
+			_, err := cache.LookupHost(context.Background(), "other.corp")
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("NewWithOpts", func() {
+		It("should answer pinned hosts without a lookup", func() {
+			it, err := NewWithOpts(Opts{Servers: []string{"192.0.2.53"}, Hosts: map[string][]string{"Proxy.Corp": {"10.0.0.1"}}})
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(it.LookupHost(context.Background(), "proxy.corp.")).Should(Equal([]string{"10.0.0.1"}))
+		})
+
+		It("should reject invalid servers", func() {
+			_, err := NewWithOpts(Opts{Servers: []string{"dns.example"}})
+			Expect(err).Should(HaveOccurred())
+
+			_, err = NewWithOpts(Opts{Domains: map[string][]string{"corp.example": {"quic://10.0.0.53"}}})
+			Expect(err).Should(HaveOccurred())
+
+			_, err = NewWithOpts(Opts{Domains: map[string][]string{"corp.example": nil}})
+			Expect(err).Should(HaveOccurred())
+
+			_, err = NewWithOpts(Opts{Hosts: map[string][]string{"proxy.corp": {"proxy.example"}}})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		Context("with encrypted servers", func() {
+			var doh *httptest.Server
+			var tlsConfig *tls.Config
+
+			BeforeEach(func() {
+				doh = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					query, _ := ioutil.ReadAll(r.Body)
+					if r.Method != "POST" || r.Header.Get("Content-Type") != "application/dns-message" {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					w.Header().Set("Content-Type", "application/dns-message")
+					w.Write(answer(query, [4]byte{10, 1, 0, 1}))
+				}))
+				tlsConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig
+			})
+
+			AfterEach(func() {
+				doh.Close()
+			})
+
+			It("should query DNS-over-HTTPS servers", func() {
+				it, err := NewWithOpts(Opts{Servers: []string{doh.URL + "/dns-query"}, TLSConfig: tlsConfig, CacheTTL: -1})
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(it.LookupHost(context.Background(), "host.doh.test")).Should(Equal([]string{"10.1.0.1"}))
+			})
+
+			It("should query DNS-over-TLS servers for their domain", func() {
+				listener, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer listener.Close()
+
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+
+						go func() {
+							defer conn.Close()
+							for {
+								var size uint16
+								if binary.Read(conn, binary.BigEndian, &size) != nil {
+									return
+								}
+								query := make([]byte, size)
+								if _, err := io.ReadFull(conn, query); err != nil {
+									return
+								}
+								reply := answer(query, [4]byte{10, 2, 0, 1})
+								binary.Write(conn, binary.BigEndian, uint16(len(reply)))
+								conn.Write(reply)
+							}
+						}()
+					}
+				}()
+
+				it, err := NewWithOpts(Opts{
+					Servers:   []string{doh.URL},
+					Domains:   map[string][]string{"dot.test": {"tls://" + listener.Addr().String()}},
+					TLSConfig: tlsConfig,
+				})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				Expect(it.LookupHost(context.Background(), "host.dot.test")).Should(Equal([]string{"10.2.0.1"}))
+				Expect(it.LookupHost(context.Background(), "host.doh.test")).Should(Equal([]string{"10.1.0.1"}))
+			})
+
+			It("should fail when the DNS-over-HTTPS server does", func() {
+				doh.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				})
+
+				it, err := NewWithOpts(Opts{Servers: []string{doh.URL}, TLSConfig: tlsConfig})
+				Expect(err).ShouldNot(HaveOccurred())
+
+				_, err = it.LookupHost(context.Background(), "host.doh.test")
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+	})
+})
@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultCacheTTL is how long NewWithOpts caches lookups unless told otherwise
+const DefaultCacheTTL = time.Minute
+
+// Opts configures a split-horizon resolver. Server lists take the forms accepted by NewServers.
+type Opts struct {
+	// Servers answer lookups for names not under any of Domains. Empty means the system resolver.
+	Servers []string `json:"servers,omitempty"`
+	// Domains maps a domain to the servers for it and every name under it. The longest matching domain wins.
+	Domains map[string][]string `json:"domains,omitempty"`
+	// Hosts pins names to IP addresses; they are never looked up
+	Hosts map[string][]string `json:"hosts,omitempty"`
+	// CacheTTL is how many seconds lookups are cached for. Zero means DefaultCacheTTL; negative disables caching.
+	CacheTTL int `json:"cache_ttl,omitempty"`
+	// TLSConfig is used for DNS-over-TLS and DNS-over-HTTPS servers
+	TLSConfig *tls.Config `json:"-"`
+}
+
+// IsZero reports whether opts leaves everything to the system resolver
+func (o Opts) IsZero() bool {
+	return len(o.Servers) == 0 && len(o.Domains) == 0 && len(o.Hosts) == 0
+}
+
+// NewWithOpts returns a resolver answering from Hosts, then the servers for the domain of the name, then Servers.
+// It returns an error if a server is invalid.
+func NewWithOpts(opts Opts) (Resolver, error) {
+	fallback, err := NewServers(opts.Servers, opts.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	split := &Split{Domains: make(map[string]Resolver), Default: fallback}
+	for domain, servers := range opts.Domains {
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("No DNS servers given for domain '%s'", domain)
+		}
+
+		split.Domains[domain], err = NewServers(servers, opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resolver Resolver = split
+	if opts.CacheTTL >= 0 {
+		ttl := time.Duration(opts.CacheTTL) * time.Second
+		if ttl == 0 {
+			ttl = DefaultCacheTTL
+		}
+		resolver = NewCache(resolver, ttl)
+	}
+
+	if len(opts.Hosts) > 0 {
+		pins := make(Static)
+		for host, addrs := range opts.Hosts {
+			for _, addr := range addrs {
+				if net.ParseIP(addr) == nil {
+					return nil, fmt.Errorf("Invalid address '%s' for host '%s'", addr, host)
+				}
+			}
+			pins[normalise(host)] = addrs
+		}
+		resolver = &pinned{pins: pins, next: resolver}
+	}
+
+	return resolver, nil
+}
+
+// Split sends lookups for names under each of Domains to its resolver and everything else to Default
+type Split struct {
+	Domains map[string]Resolver
+	Default Resolver
+}
+
+// LookupHost looks up host with the resolver for the longest domain it is under
+func (s *Split) LookupHost(ctx context.Context, host string) ([]string, error) {
+	name := normalise(host)
+
+	var best string
+	resolver := s.Default
+	for domain, r := range s.Domains {
+		domain = normalise(domain)
+		if len(domain) > len(best) && (name == domain || strings.HasSuffix(name, "."+domain)) {
+			best = domain
+			resolver = r
+		}
+	}
+
+	return resolver.LookupHost(ctx, host)
+}
+
+// pinned answers lookups for pinned names itself and passes the rest on
+type pinned struct {
+	pins Static
+	next Resolver
+}
+
+func (p *pinned) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := p.pins[normalise(host)]; ok && len(addrs) > 0 {
+		return addrs, nil
+	}
+	return p.next.LookupHost(ctx, host)
+}
+
+// normalise lower cases a name and removes any trailing dot
+func normalise(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
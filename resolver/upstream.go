@@ -0,0 +1,200 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dohMediaType is the content type of DNS-over-HTTPS requests and responses (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// NewServers returns a resolver that queries the given servers in turn, or the system resolver if there are none.
+// Servers are "ip" or "ip:port" (port 53), "tls://host[:port]" for DNS-over-TLS (port 853) or an https:// URL for
+// DNS-over-HTTPS. tlsConfig is used for both; nil means the Go defaults.
+func NewServers(servers []string, tlsConfig *tls.Config) (Resolver, error) {
+	if len(servers) == 0 {
+		return net.DefaultResolver, nil
+	}
+
+	var dials []func(ctx context.Context, network string) (net.Conn, error)
+	for _, server := range servers {
+		dial, err := serverDialer(server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		dials = append(dials, dial)
+	}
+
+	var next uint32
+
+	// The Go resolver does the DNS work; it frames messages for a stream when the conn isn't a net.PacketConn
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dials[int(atomic.AddUint32(&next, 1)-1)%len(dials)](ctx, network)
+		},
+	}, nil
+}
+
+// serverDialer returns a function connecting to the DNS server given as in NewServers
+func serverDialer(server string, tlsConfig *tls.Config) (func(ctx context.Context, network string) (net.Conn, error), error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		return dohDialer(server, tlsConfig, dialer), nil
+
+	case strings.HasPrefix(server, "tls://"):
+		addr := strings.TrimPrefix(server, "tls://")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+			addr = net.JoinHostPort(addr, "853")
+		}
+		if host == "" {
+			return nil, fmt.Errorf("Invalid DNS server '%s'", server)
+		}
+
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+
+		return func(ctx context.Context, network string) (net.Conn, error) {
+			return (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, "tcp", addr)
+		}, nil
+
+	case strings.Contains(server, "://"):
+		return nil, fmt.Errorf("Unsupported DNS server '%s'; expected ip[:port], tls:// or https://", server)
+	}
+
+	addr := server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("Invalid DNS server '%s'; plain DNS servers must be IP addresses", server)
+	}
+
+	return func(ctx context.Context, network string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// dohDialer returns a function making conns that send each DNS message written to them as a DNS-over-HTTPS POST
+func dohDialer(url string, tlsConfig *tls.Config, dialer *net.Dialer) func(ctx context.Context, network string) (net.Conn, error) {
+	// DNS queries must never go through a proxy; pacyak is probably the proxy
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 5 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+
+	return func(ctx context.Context, network string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, client: client, url: url}, nil
+	}
+}
+
+// dohConn carries DNS messages framed for TCP (RFC 1035 section 4.2.2) over HTTPS.
+// Each complete message written is posted and its answer queued to be read.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	// deadline bounds the HTTP request. The whole exchange happens in Write so read and write deadlines both set it.
+	deadline time.Time
+
+	written bytes.Buffer
+	answers bytes.Buffer
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+
+	for c.written.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.written.Bytes()))
+		if c.written.Len() < 2+size {
+			break
+		}
+
+		c.written.Next(2)
+		answer, err := c.exchange(c.written.Next(size))
+		if err != nil {
+			return 0, err
+		}
+
+		binary.Write(&c.answers, binary.BigEndian, uint16(len(answer)))
+		c.answers.Write(answer)
+	}
+
+	return len(p), nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	if c.answers.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answers.Read(p)
+}
+
+// exchange posts a DNS message and returns the answer
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	request, err := http.NewRequest("POST", c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", dohMediaType)
+	request.Header.Set("Accept", dohMediaType)
+
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server %s returned %s", c.url, response.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(response.Body, 65535))
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { c.deadline = t; return nil }
+
+// dohAddr is the address of a DNS-over-HTTPS server
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
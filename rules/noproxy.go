@@ -0,0 +1,47 @@
+package rules
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FromNoProxy converts a NO_PROXY style list into DIRECT rules.
+// Entries are separated by commas or whitespace and may be "*", a domain ("example.com" or ".example.com",
+// both matching subdomains too), an IP address or CIDR, any of which may carry a ":port".
+func FromNoProxy(list string) []Rule {
+	var rules []Rule
+
+	fields := strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+
+	for _, entry := range fields {
+		rule := Rule{Action: "DIRECT"}
+
+		if entry == "*" {
+			rules = append(rules, rule)
+			continue
+		}
+
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				entry = host
+				rule.Ports = []int{p}
+			}
+		}
+
+		entry = strings.Trim(entry, "[]")
+
+		if _, _, err := net.ParseCIDR(entry); err == nil || net.ParseIP(entry) != nil {
+			rule.CIDRs = []string{entry}
+		} else {
+			domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			rule.Hosts = []string{domain, "*." + domain}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
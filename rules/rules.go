@@ -0,0 +1,235 @@
+/*
+Package rules implements local routing exceptions that are checked before the PAC.
+
+Rules are evaluated in order and the first match wins. A rule matches when every condition it sets matches;
+conditions left empty match anything. The action is a PAC style result ("DIRECT", "PROXY host:port; DIRECT")
+or one of the special actions BLOCK and PAC.
+*/
+package rules
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Special actions
+const (
+	// Block refuses the request with a 403. Any text after it ("BLOCK telemetry") is given as the reason.
+	Block = "BLOCK"
+	// Pac stops evaluating rules and asks the PAC
+	Pac = "PAC"
+)
+
+// Rule is a single routing exception as it appears in the config file
+type Rule struct {
+	// Hosts are host name globs, e.g. "staging.corp" or "*.partner.com"
+	Hosts []string `json:"hosts,omitempty"`
+	// CIDRs match hosts given as IP addresses; names are not resolved
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Ports match the destination port
+	Ports []int `json:"ports,omitempty"`
+	// Schemes match the request scheme; CONNECT requests are treated as https
+	Schemes []string `json:"schemes,omitempty"`
+	// Sources are CIDRs matching the client address
+	Sources []string `json:"sources,omitempty"`
+	// Action is DIRECT, a PAC style proxy list, BLOCK or PAC
+	Action string `json:"action"`
+	// Interface and SourceAddress bind the connections of matching requests, whichever way they are routed
+	Interface     string `json:"interface,omitempty"`
+	SourceAddress string `json:"source_address,omitempty"`
+}
+
+// Result is the outcome of evaluating rules for a request
+type Result struct {
+	// Action is the matching rule's action, or "" if the PAC should decide
+	Action string
+	// Interface and SourceAddress are the matching rule's binding, if it has one
+	Interface     string
+	SourceAddress string
+}
+
+// Request is what rules are matched against
+type Request struct {
+	Scheme string
+	Host   string
+	Port   int
+	Source net.IP
+}
+
+type compiledRule struct {
+	hosts   []string
+	cidrs   []*net.IPNet
+	ports   map[int]bool
+	schemes map[string]bool
+	sources []*net.IPNet
+	action  string
+
+	iface         string
+	sourceAddress string
+}
+
+// Rules is a compiled, ordered rule list. The zero value and nil match nothing.
+type Rules struct {
+	rules []compiledRule
+}
+
+// Compile validates and prepares rules for matching
+func Compile(rules []Rule) (*Rules, error) {
+	compiled := &Rules{}
+
+	for i, rule := range rules {
+		c := compiledRule{action: strings.TrimSpace(rule.Action), iface: rule.Interface, sourceAddress: rule.SourceAddress}
+
+		if c.action == "" {
+			return nil, fmt.Errorf("Rule %d has no action", i+1)
+		}
+
+		if c.sourceAddress != "" && net.ParseIP(c.sourceAddress) == nil {
+			return nil, fmt.Errorf("Rule %d has invalid source address '%s'", i+1, c.sourceAddress)
+		}
+
+		for _, host := range rule.Hosts {
+			host = strings.ToLower(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("Rule %d has invalid host pattern '%s'", i+1, host)
+			}
+			c.hosts = append(c.hosts, host)
+		}
+
+		var err error
+		if c.cidrs, err = parseCIDRs(rule.CIDRs); err != nil {
+			return nil, fmt.Errorf("Rule %d: %s", i+1, err)
+		}
+
+		if c.sources, err = parseCIDRs(rule.Sources); err != nil {
+			return nil, fmt.Errorf("Rule %d: %s", i+1, err)
+		}
+
+		if len(rule.Ports) > 0 {
+			c.ports = make(map[int]bool)
+			for _, port := range rule.Ports {
+				c.ports[port] = true
+			}
+		}
+
+		if len(rule.Schemes) > 0 {
+			c.schemes = make(map[string]bool)
+			for _, scheme := range rule.Schemes {
+				c.schemes[strings.ToLower(scheme)] = true
+			}
+		}
+
+		compiled.rules = append(compiled.rules, c)
+	}
+
+	return compiled, nil
+}
+
+// Evaluate returns the action of the first rule matching req.
+// If no rule matches, or the matching rule's action is PAC, it returns "" and the PAC should decide.
+func (r *Rules) Evaluate(req Request) string {
+	return r.Match(req).Action
+}
+
+// Match returns the action and binding of the first rule matching req. The action is "" as for Evaluate.
+func (r *Rules) Match(req Request) Result {
+	if r == nil {
+		return Result{}
+	}
+
+	host := strings.ToLower(strings.Trim(req.Host, "[]"))
+	ip := net.ParseIP(host)
+
+	for _, rule := range r.rules {
+		if rule.matches(req, host, ip) {
+			result := Result{Action: rule.action, Interface: rule.iface, SourceAddress: rule.sourceAddress}
+			if strings.EqualFold(rule.action, Pac) {
+				result.Action = ""
+			}
+			return result
+		}
+	}
+
+	return Result{}
+}
+
+// Len returns the number of rules
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.rules)
+}
+
+func (rule compiledRule) matches(req Request, host string, ip net.IP) bool {
+	if rule.schemes != nil && !rule.schemes[strings.ToLower(req.Scheme)] {
+		return false
+	}
+
+	if rule.ports != nil && !rule.ports[req.Port] {
+		return false
+	}
+
+	if rule.sources != nil && !containsIP(rule.sources, req.Source) {
+		return false
+	}
+
+	// Hosts and CIDRs are alternative ways of naming the destination so either may match
+	if rule.hosts == nil && rule.cidrs == nil {
+		return true
+	}
+
+	for _, pattern := range rule.hosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+
+	return containsIP(rule.cidrs, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseCIDRs parses CIDRs, accepting plain addresses as single host networks
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address '%s'", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = cidr + "/" + strconv.Itoa(bits)
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR '%s'", cidr)
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
@@ -0,0 +1,122 @@
+package rules_test
+
+import (
+	. "github.com/mikesimons/pacyak/rules"
+
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rules", func() {
+	request := func(scheme, host string, port int) Request {
+		return Request{Scheme: scheme, Host: host, Port: port, Source: net.ParseIP("127.0.0.1")}
+	}
+
+	Describe("Compile", func() {
+		It("should reject rules without an action", func() {
+			_, err := Compile([]Rule{{Hosts: []string{"example.com"}}})
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should reject invalid CIDRs and patterns", func() {
+			_, err := Compile([]Rule{{CIDRs: []string{"10.0.0.0/33"}, Action: "DIRECT"}})
+			Expect(err).Should(HaveOccurred())
+
+			_, err = Compile([]Rule{{Hosts: []string{"[example.com"}, Action: "DIRECT"}})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("Evaluate", func() {
+		It("should return the action of the first matching rule", func() {
+			it, err := Compile([]Rule{
+				{Hosts: []string{"staging.corp"}, Action: "DIRECT"},
+				{Hosts: []string{"*.partner.com"}, Action: "PROXY partner.proxy:3128"},
+				{Hosts: []string{"*.corp"}, Action: "BLOCK"},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(it.Evaluate(request("http", "staging.corp", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("https", "API.Partner.com", 443))).Should(Equal("PROXY partner.proxy:3128"))
+			Expect(it.Evaluate(request("http", "wiki.corp", 80))).Should(Equal(Block))
+			Expect(it.Evaluate(request("http", "google.com", 80))).Should(Equal(""))
+		})
+
+		It("should match CIDRs against IP hosts", func() {
+			it, _ := Compile([]Rule{{CIDRs: []string{"127.0.0.0/8", "::1"}, Action: "DIRECT"}})
+			Expect(it.Evaluate(request("http", "127.0.0.5", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "[::1]", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "10.0.0.1", 80))).Should(Equal(""))
+		})
+
+		It("should require every condition of a rule to match", func() {
+			it, _ := Compile([]Rule{{Hosts: []string{"*.corp"}, Ports: []int{8443}, Schemes: []string{"https"}, Action: "DIRECT"}})
+			Expect(it.Evaluate(request("https", "app.corp", 8443))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("https", "app.corp", 443))).Should(Equal(""))
+			Expect(it.Evaluate(request("http", "app.corp", 8443))).Should(Equal(""))
+		})
+
+		It("should match client source addresses", func() {
+			it, _ := Compile([]Rule{{Sources: []string{"10.1.0.0/16"}, Action: "BLOCK"}})
+			Expect(it.Evaluate(Request{Scheme: "http", Host: "google.com", Port: 80, Source: net.ParseIP("10.1.2.3")})).Should(Equal(Block))
+			Expect(it.Evaluate(request("http", "google.com", 80))).Should(Equal(""))
+		})
+
+		It("should defer to the PAC for PAC actions", func() {
+			it, _ := Compile([]Rule{
+				{Hosts: []string{"special.corp"}, Action: "PAC"},
+				{Hosts: []string{"*.corp"}, Action: "DIRECT"},
+			})
+			Expect(it.Evaluate(request("http", "special.corp", 80))).Should(Equal(""))
+			Expect(it.Evaluate(request("http", "other.corp", 80))).Should(Equal("DIRECT"))
+		})
+
+		It("should match nothing when nil", func() {
+			var it *Rules
+			Expect(it.Evaluate(request("http", "google.com", 80))).Should(Equal(""))
+		})
+	})
+
+	Describe("Match", func() {
+		It("should return the binding of the matching rule with its action", func() {
+			it, err := Compile([]Rule{
+				{Hosts: []string{"*.vpn.corp"}, Action: "DIRECT", Interface: "tun0"},
+				{Hosts: []string{"*.corp"}, Action: "PAC", SourceAddress: "10.8.0.2"},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(it.Match(request("http", "app.vpn.corp", 80))).Should(Equal(Result{Action: "DIRECT", Interface: "tun0"}))
+			Expect(it.Match(request("http", "wiki.corp", 80))).Should(Equal(Result{SourceAddress: "10.8.0.2"}))
+			Expect(it.Match(request("http", "google.com", 80))).Should(Equal(Result{}))
+		})
+
+		It("should return an error for invalid source addresses", func() {
+			_, err := Compile([]Rule{{Action: "DIRECT", SourceAddress: "tun0"}})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("FromNoProxy", func() {
+		It("should convert NO_PROXY entries to DIRECT rules", func() {
+			it, err := Compile(FromNoProxy("localhost, .example.com,10.0.0.0/8 ::1 internal.corp:8080"))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(it.Len()).Should(Equal(5))
+
+			Expect(it.Evaluate(request("http", "localhost", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "example.com", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "www.example.com", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "10.20.30.40", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "[::1]", 80))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "internal.corp", 8080))).Should(Equal("DIRECT"))
+			Expect(it.Evaluate(request("http", "internal.corp", 80))).Should(Equal(""))
+			Expect(it.Evaluate(request("http", "google.com", 80))).Should(Equal(""))
+		})
+
+		It("should bypass everything for *", func() {
+			it, _ := Compile(FromNoProxy("*"))
+			Expect(it.Evaluate(request("http", "google.com", 80))).Should(Equal("DIRECT"))
+		})
+	})
+})
@@ -0,0 +1,728 @@
+// Package server contains the pacyak application: a local proxy that routes requests according to a PAC file
+// and falls back to direct connections when the PAC environment is unavailable.
+//
+// It can be embedded in other Go programs:
+//
+//	srv := server.New(&server.Opts{PacFile: "http://wpad.corp/proxy.pac", PingCheckHost: "wpad.corp"})
+//	listener, _ := net.Listen("tcp", "127.0.0.1:8080")
+//	go srv.Serve(listener)
+//	...
+//	srv.Shutdown(ctx)
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mikesimons/earl"
+	"github.com/mikesimons/pacyak/auth"
+	"github.com/mikesimons/pacyak/config"
+	"github.com/mikesimons/pacyak/pacsandbox"
+	"github.com/mikesimons/pacyak/policy"
+	"github.com/mikesimons/pacyak/proxy"
+	"github.com/mikesimons/pacyak/proxyfactory"
+	"github.com/mikesimons/pacyak/resolver"
+	"github.com/mikesimons/pacyak/rules"
+	"github.com/mikesimons/readly"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// State indicates whether the server is routing through the PAC file or directly
+type State int
+
+const (
+	// StateDirect means all requests are sent directly (ping check failed)
+	StateDirect State = iota
+	// StatePac means requests are routed according to the PAC file (ping check passed)
+	StatePac
+)
+
+func (s State) String() string {
+	if s == StatePac {
+		return "pac"
+	}
+	return "direct"
+}
+
+// Opts holds runtime config options for Server
+type Opts struct {
+	PingCheckHost string
+	PacFile       string
+	ListenAddr    string
+	PacProxy      string
+
+	// PacOverlay is the location of a JavaScript overlay wrapping the PAC; see pacsandbox.Opts.Overlay.
+	// It is read whenever the PAC is.
+	PacOverlay string
+
+	// ForwardProxyAuth passes client Proxy-Authorization headers to upstream proxies unless an upstream's config says
+	// otherwise. Ignored while client authentication is enabled as the credentials are then for pacyak.
+	ForwardProxyAuth bool
+
+	// AddVia adds pacyak to the Via header of proxied requests and responses
+	AddVia bool
+	// AddForwardedFor appends the client address to X-Forwarded-For on proxied requests
+	AddForwardedFor bool
+
+	// TunnelIdleTimeout closes CONNECT and WebSocket tunnels idle for this long. Zero means never.
+	TunnelIdleTimeout time.Duration
+
+	// HTTP2 accepts HTTP/2 from clients: with prior knowledge or an h2c upgrade on a plain listener, and negotiated
+	// over TLS when TLSCertFile is set. CONNECT tunnels from HTTP/2 clients share their client connection.
+	HTTP2 bool
+	// UpstreamHTTP2 multiplexes CONNECT tunnels over HTTP/2 connections to upstream proxies unless an upstream's
+	// config says otherwise; see proxy.Opts.HTTP2
+	UpstreamHTTP2 bool
+
+	// UpstreamTLSConfig is used for connections to https proxies unless an upstream's config has its own TLS settings
+	UpstreamTLSConfig *tls.Config
+	// Bind sets the interface and source address of outgoing connections unless a rule or upstream's config says
+	// otherwise. See ValidateBinding.
+	Bind proxy.Binding
+
+	// Resolver looks up destinations of direct connections and the names of upstream proxies unless the config file
+	// has a dns section. It is also used by the PAC when PacOpts has no Resolver. Nil means the system resolver.
+	Resolver resolver.Resolver
+
+	// UpstreamSSHConfig returns the settings for connecting to SSH bastions; see proxy.Opts.SSHConfig
+	UpstreamSSHConfig func(user, addr string) *ssh.ClientConfig
+	// PacTLSConfig is used to fetch the PAC and overlay from HTTPS servers
+	PacTLSConfig *tls.Config
+
+	// TLSCertFile and TLSKeyFile serve the listener over TLS for clients that support HTTPS proxies
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ConfigFile is the path of the JSON config file holding routing rules. It is read by Reload.
+	ConfigFile string
+
+	// PacOpts configures the PAC sandbox: evaluation timeout and fallback, JavaScript engine and caching
+	PacOpts pacsandbox.Opts
+
+	// MyIPAddress overrides the address returned by the PAC myIpAddress function.
+	// By default it is the source address of the route to PingCheckHost, updated when the network changes.
+	MyIPAddress string
+
+	// OnStateChange is invoked whenever the server switches between direct and PAC routing
+	OnStateChange func(State)
+
+	// Logger receives the server log output. Defaults to the logrus standard logger.
+	Logger *log.Logger
+}
+
+// pacInterpreter is a simple interface we use to provide a dummy implementation of pacsandbox for directPac
+type pacInterpreter interface {
+	ProxyFor(string) (string, error)
+	Reset() // HACK
+}
+
+// directPac is a dummy implementation of pacsandbox to avoid invoking JS to return a constant static string ("DIRECT")
+type directPac struct{}
+
+func (p *directPac) ProxyFor(s string) (string, error) { return "DIRECT", nil }
+func (p *directPac) Reset()                            {}
+
+// Server holds all application state
+type Server struct {
+	opts         *Opts
+	pacFile      *earl.URL
+	state        State
+	sandboxes    []pacInterpreter
+	factory      *proxyfactory.ProxyFactory
+	interfaceMap map[string]string
+	myIPAddress  string
+	log          *log.Logger
+	Reader       *readly.Reader
+
+	rules       *rules.Rules
+	policy      *policy.Enforcer
+	auth        *auth.Authenticator
+	resolver    resolver.Resolver
+	configError error
+
+	pacLoaded    bool
+	pacLoadedAt  time.Time
+	pacLoadError error
+
+	stateLock  sync.RWMutex
+	checkLock  sync.Mutex
+	startOnce  sync.Once
+	done       chan struct{}
+	httpServer *http.Server
+}
+
+// New is the constructor for Server
+func New(opts *Opts) *Server {
+	reader := readly.New()
+
+	// We need to explicitly set HTTP client to prevent it trying to use ENV vars for proxy
+	// pacyak listen addr is expected to be set as HTTP_PROXY / HTTPS_PROXY but it isn't started yet!
+	// This level of control also means a lib like hashicorp/go-getter is not suitable :(
+	reader.Client = &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				if opts.PacProxy != "" {
+					return url.Parse(opts.PacProxy)
+				}
+
+				return nil, nil
+			},
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 5 * time.Second,
+			}).DialContext,
+			IdleConnTimeout: 5 * time.Second,
+			TLSClientConfig: opts.PacTLSConfig,
+		},
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+
+	factory := proxyfactory.New()
+	factory.SetOpts(proxyDefaults(opts), nil)
+
+	return &Server{
+		opts:      opts,
+		resolver:  opts.Resolver,
+		pacFile:   earl.Parse(opts.PacFile),
+		factory:   factory,
+		state:     StateDirect,
+		sandboxes: []pacInterpreter{&directPac{}, &directPac{}},
+		log:       logger,
+		Reader:    reader,
+		done:      make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on the configured ListenAddr and serves requests until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.opts.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve starts the availability monitors and serves proxy requests from the given listener.
+// It always returns a non-nil error; after Shutdown the error is http.ErrServerClosed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.startOnce.Do(func() {
+		go s.monitorPingAvailability()
+		go s.monitorNetworkInterfaces()
+	})
+
+	httpServer := &http.Server{Handler: s}
+
+	if s.opts.HTTP2 {
+		h2Server := &http2.Server{}
+		if err := http2.ConfigureServer(httpServer, h2Server); err != nil {
+			return err
+		}
+		httpServer.Handler = h2c.NewHandler(s, h2Server)
+	} else {
+		// net/http would otherwise negotiate HTTP/2 over TLS by itself
+		httpServer.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	s.stateLock.Lock()
+	s.httpServer = httpServer
+	s.stateLock.Unlock()
+
+	if s.opts.TLSCertFile != "" {
+		return httpServer.ServeTLS(listener, s.opts.TLSCertFile, s.opts.TLSKeyFile)
+	}
+
+	return httpServer.Serve(listener)
+}
+
+// Shutdown stops the availability monitors and gracefully shuts down the listener.
+// Established CONNECT tunnels are not tracked and are left to finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stateLock.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+		s.factory.Close()
+	}
+	httpServer := s.httpServer
+	s.stateLock.Unlock()
+
+	if httpServer == nil {
+		return nil
+	}
+
+	return httpServer.Shutdown(ctx)
+}
+
+// Reload reads the config file and applies its rules, policy and client access settings. If the config is invalid the current ones are kept.
+// It does nothing if no ConfigFile is set.
+func (s *Server) Reload() error {
+	if s.opts.ConfigFile == "" {
+		return nil
+	}
+
+	var compiled *rules.Rules
+	var enforcer *policy.Enforcer
+	var authenticator *auth.Authenticator
+	var dns resolver.Resolver
+	cfg, err := config.Load(s.opts.ConfigFile)
+	if err == nil {
+		compiled, err = cfg.CompileRules()
+	}
+	if err == nil {
+		enforcer, err = policy.Compile(cfg.Policy)
+	}
+	if err == nil {
+		authenticator, err = auth.New(cfg.Auth)
+	}
+
+	if err == nil {
+		dns, err = cfg.Resolver(s.opts.UpstreamTLSConfig)
+	}
+
+	defaults := proxyDefaults(s.opts)
+	if dns != nil {
+		defaults.Resolver = dns
+	}
+	var upstreams map[string]proxy.Opts
+	if err == nil {
+		upstreams, err = cfg.ProxyOpts(defaults)
+	}
+
+	s.stateLock.Lock()
+	s.configError = err
+	if err == nil {
+		s.rules = compiled
+		s.policy = enforcer
+		s.auth = authenticator
+		s.resolver = defaults.Resolver
+	}
+	s.stateLock.Unlock()
+
+	if err == nil {
+		s.factory.SetOpts(defaults, upstreams)
+	}
+
+	if err != nil {
+		s.log.WithFields(log.Fields{"file": s.opts.ConfigFile, "error": err}).Error("Unable to load config; keeping current rules")
+		return err
+	}
+
+	for _, warning := range bindingWarnings(cfg) {
+		s.log.WithFields(log.Fields{"file": s.opts.ConfigFile}).Warn(warning)
+	}
+
+	s.log.WithFields(log.Fields{"file": s.opts.ConfigFile, "rules": compiled.Len()}).Info("Loaded config")
+	return nil
+}
+
+// State returns the current routing state
+func (s *Server) State() State {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	return s.state
+}
+
+// ServeHTTP handles directing the request to the correct proxy
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.log.WithFields(log.Fields{
+		"method": r.Method,
+		"url":    r.URL.String(),
+	}).Debug("Processing HTTP request")
+
+	s.stateLock.RLock()
+	compiled, enforcer, authenticator := s.rules, s.policy, s.auth
+	s.stateLock.RUnlock()
+
+	proxyRequestURL(r)
+	req := ruleRequest(r)
+
+	if !authenticator.AllowClient(req.Source) {
+		s.log.WithFields(log.Fields{"client": r.RemoteAddr}).Warn("Client not allowed")
+		http.Error(w, "Client not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Requests for our own paths (rather than proxy requests) are admin requests
+	admin := !r.URL.IsAbs() && r.Method != "CONNECT"
+
+	header, challenge, status := "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+	if admin {
+		header, challenge, status = "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+	}
+
+	user, ok := authenticator.Authenticate(r.Header.Get(header))
+	if !ok {
+		s.log.WithFields(log.Fields{"client": r.RemoteAddr}).Info("Client failed to authenticate")
+		w.Header().Set(challenge, `Basic realm="`+authenticator.Realm()+`"`)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Client credentials for us must never reach the upstream. Otherwise the proxy decides whether to forward them.
+	if authenticator.RequiresAuth() {
+		r.Header.Del("Proxy-Authorization")
+	}
+
+	if admin {
+		s.serveAdmin(w, r)
+		return
+	}
+
+	if user != "" {
+		s.log.WithFields(log.Fields{"user": user}).Debug("Client authenticated")
+	}
+
+	if err := enforcer.Check(r.Method, req.Host, req.Port); err != nil {
+		s.log.WithFields(log.Fields{"url": r.URL.String(), "reason": err}).Info("Request denied by policy")
+		http.Error(w, "Blocked by pacyak: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	route := compiled.Match(req)
+	pacResponse := route.Action
+
+	if pacResponse != "" {
+		s.log.WithFields(log.Fields{"response": pacResponse}).Debug("Rule result")
+	} else {
+		var err error
+		pacResponse, err = s.activeSandbox().ProxyFor(r.URL.String())
+
+		if err != nil {
+			s.log.WithFields(log.Fields{"response": pacResponse, "sandbox_error": err, "url": r.URL.String()}).Error("Sandbox error!")
+		} else {
+			s.log.WithFields(log.Fields{"response": pacResponse}).Debug("PAC result")
+		}
+	}
+
+	proxy := s.factory.FromPacResponseWithBinding(pacResponse, proxy.Binding{Interface: route.Interface, SourceAddress: route.SourceAddress})
+	if proxy == nil {
+		reason := blockReason(pacResponse)
+		s.log.WithFields(log.Fields{"url": r.URL.String(), "reason": reason}).Info("Request blocked")
+		http.Error(w, "Blocked by pacyak: "+reason, http.StatusForbidden)
+		return
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// MyIPAddress returns the address the PAC sees from myIpAddress
+func (s *Server) MyIPAddress() string {
+	s.stateLock.RLock()
+	address := s.myIPAddress
+	s.stateLock.RUnlock()
+
+	if address == "" {
+		return s.updateMyIPAddress()
+	}
+	return address
+}
+
+// updateMyIPAddress works out the address for myIpAddress again and returns it.
+// We use the address the kernel would route from to reach the ping host as that is the network the PAC cares about.
+func (s *Server) updateMyIPAddress() string {
+	address := s.opts.MyIPAddress
+	if address == "" {
+		address = pacsandbox.SourceAddress(s.pingTarget())
+	}
+
+	s.stateLock.Lock()
+	changed := s.myIPAddress != "" && s.myIPAddress != address
+	s.myIPAddress = address
+	s.stateLock.Unlock()
+
+	if changed {
+		s.log.WithFields(log.Fields{"address": address}).Info("myIpAddress changed")
+		// Cached results may depend on the old address
+		s.activeSandbox().Reset()
+	}
+
+	return address
+}
+
+// pingTarget returns the host used to find the route to the proxy network
+func (s *Server) pingTarget() string {
+	if s.opts.PingCheckHost != "" {
+		return s.opts.PingCheckHost
+	}
+	return s.pacFile.Host
+}
+
+// proxyDefaults returns the upstream proxy options set for the listener
+func proxyDefaults(opts *Opts) proxy.Opts {
+	return proxy.Opts{
+		ForwardAuth:  opts.ForwardProxyAuth,
+		Via:          opts.AddVia,
+		ForwardedFor: opts.AddForwardedFor,
+		IdleTimeout:  opts.TunnelIdleTimeout,
+		HTTP2:        opts.UpstreamHTTP2,
+		TLSConfig:    opts.UpstreamTLSConfig,
+		SSHConfig:    opts.UpstreamSSHConfig,
+		Bind:         opts.Bind,
+		Resolver:     opts.Resolver,
+	}
+}
+
+// proxyRequestURL gives HTTP/2 proxy requests the absolute URL an HTTP/1 client would send. The HTTP/2 server builds
+// r.URL from :path alone so requests for any :authority but the listener are taken to be for that host.
+func proxyRequestURL(r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method == "CONNECT" || r.URL.IsAbs() || r.Host == "" {
+		return
+	}
+
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if local != nil && isListenerHost(r.Host, local, r.TLS != nil) {
+		return
+	}
+
+	r.URL.Scheme = "http"
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+	r.URL.Host = r.Host
+}
+
+// ruleRequest describes r for matching against rules and policy
+func ruleRequest(r *http.Request) rules.Request {
+	req := rules.Request{Scheme: r.URL.Scheme, Host: r.URL.Hostname()}
+
+	// CONNECT is almost always a TLS tunnel
+	if r.Method == "CONNECT" {
+		req.Scheme = "https"
+	}
+
+	req.Port, _ = strconv.Atoi(r.URL.Port())
+	if req.Port == 0 {
+		req.Port = 80
+		if req.Scheme == "https" || req.Scheme == "wss" {
+			req.Port = 443
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Source = net.ParseIP(host)
+	}
+
+	return req
+}
+
+// blockReason returns the reason given by the first BLOCK entry of a rule or PAC result
+func blockReason(response string) string {
+	for _, entry := range proxyfactory.ParsePacResponse(response) {
+		if entry.Type != rules.Block {
+			continue
+		}
+		if entry.Host != "" {
+			return entry.Host
+		}
+		break
+	}
+
+	return "blocked by rule"
+}
+
+// switchToDirect switches the pac sandbox to the dummy "DIRECT" implementation
+// We do this when our ping check fails (indicating a proxy may no longer be required)
+func (s *Server) switchToDirect() {
+	if s.State() != StateDirect {
+		s.log.Info("PAC availability check failed; switching to direct")
+		s.setState(StateDirect)
+	}
+}
+
+// switchToPac switches the pac sandbox to the JS implementation (using the PAC file specified on the CLI)
+// We do this when our ping check passes (indicating we're in an env that requires a proxy)
+// If the PAC fails to load we keep the last one that loaded successfully, if there is one
+func (s *Server) switchToPac() {
+	if s.State() != StateDirect {
+		return
+	}
+
+	pac, err := s.Reader.Read(s.pacFile.Input)
+	if err != nil {
+		s.log.WithFields(log.Fields{"error": err}).Error("PAC availability check passed but was unable to fetch PAC")
+		s.setPacLoadError(err)
+		return
+	}
+
+	pacOpts := s.opts.PacOpts
+	if pacOpts.MyIPAddress == nil {
+		pacOpts.MyIPAddress = s.MyIPAddress
+	}
+	if pacOpts.Resolver == nil {
+		s.stateLock.RLock()
+		pacOpts.Resolver = s.resolver
+		s.stateLock.RUnlock()
+	}
+
+	if s.opts.PacOverlay != "" {
+		pacOpts.Overlay, err = s.Reader.Read(s.opts.PacOverlay)
+		if err != nil {
+			s.log.WithFields(log.Fields{"error": err}).Error("Unable to read PAC overlay")
+		}
+	}
+
+	var sandbox *pacsandbox.PacSandbox
+	if err == nil {
+		sandbox, err = pacsandbox.NewWithOpts(pac, &pacOpts)
+	}
+
+	if err != nil {
+		s.setPacLoadError(err)
+
+		if !s.hasLoadedPac() {
+			s.log.WithFields(log.Fields{"error": err}).Error("PAC availability check passed but PAC failed to load; staying direct")
+			return
+		}
+
+		s.log.WithFields(log.Fields{"error": err}).Error("PAC availability check passed but PAC failed to load; using last working PAC")
+	} else {
+		s.log.Info("PAC availability check passed; switching from direct")
+		s.stateLock.Lock()
+		s.sandboxes[StatePac] = sandbox
+		s.pacLoaded = true
+		s.pacLoadedAt = time.Now()
+		s.pacLoadError = nil
+		s.stateLock.Unlock()
+	}
+
+	s.setState(StatePac)
+}
+
+func (s *Server) hasLoadedPac() bool {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	return s.pacLoaded
+}
+
+func (s *Server) setPacLoadError(err error) {
+	s.stateLock.Lock()
+	s.pacLoadError = err
+	s.stateLock.Unlock()
+}
+
+// handlePacAvailability updates the status of the ping check and switches sandbox if required
+// This may be called from multiple go routines so we wrap it in a mutex to avoid racing
+// Tried this with channels once but CPU usage blew up! Probably PEBKAC
+func (s *Server) handlePacAvailability() {
+	s.checkLock.Lock()
+	defer s.checkLock.Unlock()
+
+	available := false
+	retries := 0
+	for ; retries < 2; retries++ {
+		available = exec.Command("ping", "-w", "1", s.opts.PingCheckHost).Run() == nil
+		s.log.WithFields(log.Fields{"available": available}).Info("PAC availability check")
+
+		if !available {
+			time.Sleep(time.Second * 5)
+		} else {
+			break
+		}
+	}
+
+	if !available {
+		s.switchToDirect()
+	} else {
+		s.switchToPac()
+	}
+}
+
+// monitorPingAvailability is a wrapper for handlePacAvailability invoking it every 30 seconds until shutdown
+func (s *Server) monitorPingAvailability() {
+	s.handlePacAvailability()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.handlePacAvailability()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// checkNetworkInterfaces will trigger a ping check if network interfaces have changed since last check
+func (s *Server) checkNetworkInterfaces() {
+	interfaceMap := makeInterfaceMap()
+	lastInterfaceMap := s.interfaceMap
+
+	defer func() {
+		s.interfaceMap = interfaceMap
+	}()
+
+	newInterfaces := interfaceMapKeys(interfaceMap)
+	oldInterfaces := interfaceMapKeys(lastInterfaceMap)
+
+	if interfaceListChanged(newInterfaces, oldInterfaces) {
+		s.log.WithFields(log.Fields{"old": oldInterfaces, "new": newInterfaces}).Debug("Network interface list has changed")
+		s.updateMyIPAddress()
+		s.handlePacAvailability()
+		return
+	}
+
+	for key, val := range interfaceMap {
+		if lastInterfaceMap[key] != val {
+			s.log.WithFields(log.Fields{"interface": key, "old": lastInterfaceMap[key], "new": val}).Debug("Network interface configuration has changed")
+			s.updateMyIPAddress()
+			s.handlePacAvailability()
+			return
+		}
+	}
+
+	s.log.Debug("No network changes detected")
+}
+
+// monitorNetworkInterfaces is a wrapper for checkNetworkInterfaces invoking it every 5 seconds until shutdown
+func (s *Server) monitorNetworkInterfaces() {
+	s.interfaceMap = makeInterfaceMap()
+	s.updateMyIPAddress()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkNetworkInterfaces()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) activeSandbox() pacInterpreter {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+	return s.sandboxes[s.state]
+}
+
+// setState resets the sandbox for the given state, makes it active and notifies the OnStateChange hook
+func (s *Server) setState(state State) {
+	s.stateLock.Lock()
+	s.sandboxes[state].Reset()
+	s.state = state
+	s.stateLock.Unlock()
+
+	if s.opts.OnStateChange != nil {
+		s.opts.OnStateChange(state)
+	}
+}
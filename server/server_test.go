@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/mikesimons/pacyak/server"
+	"golang.org/x/net/http2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Server", func() {
+	Context("with BLOCK rules", func() {
+		var srv *Server
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "pacyak-server")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			configFile := filepath.Join(dir, "config.json")
+			Expect(ioutil.WriteFile(configFile, []byte(`{"rules": [
+				{"hosts": ["fallback.example"], "action": "PROXY unavailable.invalid:8080; BLOCK no proxy available"},
+				{"hosts": ["blocked.example"], "action": "BLOCK"}
+			]}`), 0600)).Should(Succeed())
+
+			logger := log.New()
+			logger.Out = ioutil.Discard
+
+			srv = New(&Opts{ConfigFile: configFile, Logger: logger})
+			Expect(srv.Reload()).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			srv.Shutdown(context.Background())
+			os.RemoveAll(dir)
+		})
+
+		It("should refuse requests routed to BLOCK", func() {
+			response := httptest.NewRecorder()
+			srv.ServeHTTP(response, httptest.NewRequest("GET", "http://blocked.example/", nil))
+
+			Expect(response.Code).Should(Equal(http.StatusForbidden))
+			Expect(response.Body.String()).Should(ContainSubstring("blocked by rule"))
+		})
+
+		It("should refuse requests that fall back to BLOCK", func() {
+			response := httptest.NewRecorder()
+			srv.ServeHTTP(response, httptest.NewRequest("GET", "http://fallback.example/", nil))
+
+			Expect(response.Code).Should(Equal(http.StatusForbidden))
+			Expect(response.Body.String()).Should(ContainSubstring("no proxy available"))
+		})
+	})
+
+	Context("with HTTP/2", func() {
+		var srv *Server
+		var listener net.Listener
+		var client *http.Client
+
+		BeforeEach(func() {
+			logger := log.New()
+			logger.Out = ioutil.Discard
+
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ShouldNot(HaveOccurred())
+
+			srv = New(&Opts{HTTP2: true, Logger: logger})
+			go srv.Serve(listener)
+
+			// Every request goes to pacyak over h2c, whatever its URL
+			client = &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+					return net.Dial(network, listener.Addr().String())
+				},
+			}}
+		})
+
+		AfterEach(func() {
+			srv.Shutdown(context.Background())
+		})
+
+		It("should proxy plain requests from HTTP/2 clients", func() {
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("from target " + r.URL.Path))
+			}))
+			defer target.Close()
+
+			response, err := client.Get(target.URL + "/page")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer response.Body.Close()
+
+			body, _ := ioutil.ReadAll(response.Body)
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(string(body)).Should(Equal("from target /page"))
+		})
+
+		It("should serve admin requests for the listener itself", func() {
+			response, err := client.Get("http://" + listener.Addr().String() + "/status")
+			Expect(err).ShouldNot(HaveOccurred())
+			defer response.Body.Close()
+
+			body, _ := ioutil.ReadAll(response.Body)
+			Expect(response.StatusCode).Should(Equal(http.StatusOK))
+			Expect(string(body)).Should(ContainSubstring(`"state": "direct"`))
+		})
+	})
+})
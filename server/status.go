@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mikesimons/pacyak/pacsandbox"
+)
+
+// Status is a snapshot of the server state as reported on the /status admin page
+type Status struct {
+	State        string     `json:"state"`
+	PacFile      string     `json:"pac_file"`
+	PacLoadedAt  *time.Time `json:"pac_loaded_at,omitempty"`
+	PacLoadError string     `json:"pac_load_error,omitempty"`
+
+	PacCache *pacsandbox.Stats `json:"pac_cache,omitempty"`
+
+	ConfigFile  string `json:"config_file,omitempty"`
+	Rules       int    `json:"rules"`
+	ConfigError string `json:"config_error,omitempty"`
+}
+
+// Status returns a snapshot of the server state
+func (s *Server) Status() Status {
+	s.stateLock.RLock()
+	defer s.stateLock.RUnlock()
+
+	status := Status{
+		State:      s.state.String(),
+		PacFile:    s.opts.PacFile,
+		ConfigFile: s.opts.ConfigFile,
+		Rules:      s.rules.Len(),
+	}
+
+	if s.configError != nil {
+		status.ConfigError = s.configError.Error()
+	}
+
+	if s.pacLoaded {
+		loadedAt := s.pacLoadedAt
+		status.PacLoadedAt = &loadedAt
+	}
+
+	if s.pacLoadError != nil {
+		status.PacLoadError = s.pacLoadError.Error()
+	}
+
+	if sandbox, ok := s.sandboxes[StatePac].(*pacsandbox.PacSandbox); ok {
+		stats := sandbox.Stats()
+		status.PacCache = &stats
+	}
+
+	return status
+}
+
+// serveAdmin handles requests made to pacyak itself rather than proxy requests
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(s.Status())
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mikesimons/pacyak/config"
+	"github.com/mikesimons/pacyak/proxy"
+)
+
+func makeInterfaceMap() map[string]string {
+	interfaceTable := make(map[string]string)
+
+	interfaces, _ := net.Interfaces()
+
+	for _, intf := range interfaces {
+		key := fmt.Sprintf("%d-%s", intf.Flags, intf.HardwareAddr.String())
+		addrs, _ := intf.Addrs()
+		for _, addr := range addrs {
+			key = fmt.Sprintf("%s-%s", key, addr.String())
+		}
+		interfaceTable[intf.Name] = key
+	}
+
+	return interfaceTable
+}
+
+func interfaceMapKeys(ifs map[string]string) []string {
+	var ret []string
+	for k, _ := range ifs {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func interfaceListChanged(listA []string, listB []string) bool {
+	if len(listA) != len(listB) {
+		return true
+	}
+
+	equal := true
+	for i, v := range listA {
+		if listB[i] != v {
+			equal = false
+			break
+		}
+	}
+	return !equal
+}
+
+// ValidateBinding checks the interface of b exists and its source address is assigned to it (or any interface if
+// none is named)
+func ValidateBinding(b proxy.Binding) error {
+	interfaces := makeInterfaceMap()
+
+	if b.Interface != "" {
+		if _, ok := interfaces[b.Interface]; !ok {
+			return fmt.Errorf("Unknown network interface '%s' (have %s)", b.Interface, strings.Join(interfaceMapKeys(interfaces), ", "))
+		}
+	}
+
+	if b.SourceAddress == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(b.SourceAddress)
+	if ip == nil {
+		return fmt.Errorf("Invalid source address '%s'", b.SourceAddress)
+	}
+
+	for _, name := range interfaceMapKeys(interfaces) {
+		if b.Interface != "" && name != b.Interface {
+			continue
+		}
+		if interfaceHasAddress(name, ip) {
+			return nil
+		}
+	}
+
+	if b.Interface != "" {
+		return fmt.Errorf("Source address %s is not assigned to interface %s", b.SourceAddress, b.Interface)
+	}
+	return fmt.Errorf("Source address %s is not assigned to any interface", b.SourceAddress)
+}
+
+func interfaceHasAddress(name string, ip net.IP) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isListenerHost reports whether host, from a request Host header, names the listener at local: the listener port
+// on localhost, the hostname of this machine or one of its addresses
+func isListenerHost(host string, local net.Addr, secure bool) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = strings.Trim(host, "[]"), "80"
+		if secure {
+			port = "443"
+		}
+	}
+
+	localIP, localPort, err := net.SplitHostPort(local.String())
+	if err != nil || port != localPort {
+		return false
+	}
+
+	if hostname, _ := os.Hostname(); strings.EqualFold(name, "localhost") || strings.EqualFold(name, hostname) {
+		return true
+	}
+
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.Equal(net.ParseIP(localIP)) {
+		return true
+	}
+
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bindingWarnings checks the bindings of every rule and upstream in cfg against the interfaces up now.
+// Interfaces such as VPN tunnels come and go so problems are only worth a warning; those connections fail until
+// the interface appears.
+func bindingWarnings(cfg *config.Config) []string {
+	var warnings []string
+
+	for i, rule := range cfg.Rules {
+		if err := ValidateBinding(proxy.Binding{Interface: rule.Interface, SourceAddress: rule.SourceAddress}); err != nil {
+			warnings = append(warnings, fmt.Sprintf("Rule %d: %s", i+1, err))
+		}
+	}
+
+	for host, upstream := range cfg.Upstreams {
+		if err := ValidateBinding(proxy.Binding{Interface: upstream.Interface, SourceAddress: upstream.SourceAddress}); err != nil {
+			warnings = append(warnings, fmt.Sprintf("Upstream %s: %s", host, err))
+		}
+	}
+
+	sort.Strings(warnings)
+	return warnings
+}
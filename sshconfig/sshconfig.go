@@ -0,0 +1,159 @@
+/*
+Package sshconfig builds the SSH client settings pacyak uses to reach bastions for SSH upstreams.
+
+Clients authenticate with keys from the SSH agent (SSH_AUTH_SOCK) and identity files, and bastions must be listed
+in known_hosts as they would be for OpenSSH. Encrypted identity files are not supported; load them into the agent.
+*/
+package sshconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultTimeout bounds connecting to and authenticating with a bastion
+const DefaultTimeout = 15 * time.Second
+
+// defaultIdentityFiles are tried, relative to ~/.ssh, when no identity files are given
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Opts holds SSH client settings
+type Opts struct {
+	// KnownHosts is the known_hosts file bastions are checked against. Defaults to ~/.ssh/known_hosts.
+	KnownHosts string
+	// IdentityFiles are private keys to authenticate with after any keys in the agent.
+	// Defaults to the usual ~/.ssh/id_* files that exist.
+	IdentityFiles []string
+	// NoAgent ignores the SSH agent
+	NoAgent bool
+}
+
+// Config holds the loaded keys and known hosts
+type Config struct {
+	auth     []ssh.AuthMethod
+	hostKeys ssh.HostKeyCallback
+}
+
+// Load reads the known_hosts and identity files and connects to the agent
+func Load(opts Opts) (*Config, error) {
+	home, _ := os.UserHomeDir()
+
+	knownHostsFile := opts.KnownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read known hosts: %s", err)
+	}
+
+	config := &Config{hostKeys: hostKeys}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && !opts.NoAgent {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			config.auth = append(config.auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	identityFiles, required := opts.IdentityFiles, true
+	if len(identityFiles) == 0 {
+		required = false
+		for _, name := range defaultIdentityFiles {
+			identityFiles = append(identityFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range identityFiles {
+		signer, err := loadIdentity(file)
+		if err != nil && required {
+			return nil, err
+		}
+		if err == nil {
+			signers = append(signers, signer)
+		}
+	}
+
+	if len(signers) > 0 {
+		config.auth = append(config.auth, ssh.PublicKeys(signers...))
+	}
+
+	if len(config.auth) == 0 {
+		return nil, errors.New("No SSH agent or identity files to authenticate with")
+	}
+
+	return config, nil
+}
+
+// loadIdentity reads an unencrypted private key
+func loadIdentity(file string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load identity %s: %s", file, err)
+	}
+
+	return signer, nil
+}
+
+// ClientConfig returns the settings for connecting to the bastion at addr as user, or the current user if empty
+func (c *Config) ClientConfig(username, addr string) *ssh.ClientConfig {
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:              username,
+		Auth:              c.auth,
+		HostKeyCallback:   c.hostKeys,
+		HostKeyAlgorithms: c.hostKeyAlgorithms(addr),
+		Timeout:           DefaultTimeout,
+	}
+}
+
+// hostKeyAlgorithms returns the algorithms of the keys known for addr so the bastion is asked for one we can check.
+// Without this the bastion may offer a key type that isn't in known_hosts and fail verification.
+func (c *Config) hostKeyAlgorithms(addr string) []string {
+	// Checking a key nobody has makes knownhosts tell us which keys it does have for the host
+	var keyErr *knownhosts.KeyError
+	err := c.hostKeys(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+
+	return algorithms
+}
+
+// unknownKey is a host key that matches nothing in known_hosts
+type unknownKey struct{}
+
+func (unknownKey) Type() string                                 { return "pacyak-unknown" }
+func (unknownKey) Marshal() []byte                              { return []byte("pacyak-unknown") }
+func (unknownKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("unknown key") }
@@ -0,0 +1,13 @@
+package sshconfig_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSshconfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sshconfig Suite")
+}
@@ -0,0 +1,93 @@
+package sshconfig_test
+
+import (
+	. "github.com/mikesimons/pacyak/sshconfig"
+
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sshconfig", func() {
+	var dir, knownHostsFile, identityFile string
+
+	publicKey := func(key interface{}) ssh.PublicKey {
+		signer, err := ssh.NewSignerFromKey(key)
+		Expect(err).ShouldNot(HaveOccurred())
+		return signer.PublicKey()
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pacyak-ssh")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+		knownHostsFile = filepath.Join(dir, "known_hosts")
+		lines := []string{
+			knownhosts.Line([]string{"bastion.corp:22"}, publicKey(edKey)),
+			knownhosts.Line([]string{"old.corp:2222"}, publicKey(rsaKey)),
+			knownhosts.Line([]string{"old.corp:2222"}, publicKey(ecKey)),
+		}
+		Expect(ioutil.WriteFile(knownHostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)).Should(Succeed())
+
+		block, err := ssh.MarshalPrivateKey(edKey, "")
+		Expect(err).ShouldNot(HaveOccurred())
+		identityFile = filepath.Join(dir, "id_ed25519")
+		Expect(ioutil.WriteFile(identityFile, pem.EncodeToMemory(block), 0600)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should build a client config for the user", func() {
+		config, err := Load(Opts{KnownHosts: knownHostsFile, IdentityFiles: []string{identityFile}, NoAgent: true})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		client := config.ClientConfig("me", "bastion.corp:22")
+		Expect(client.User).Should(Equal("me"))
+		Expect(client.Auth).Should(HaveLen(1))
+		Expect(client.Timeout).Should(Equal(DefaultTimeout))
+	})
+
+	It("should only ask bastions for the host key types in known_hosts", func() {
+		config, err := Load(Opts{KnownHosts: knownHostsFile, IdentityFiles: []string{identityFile}, NoAgent: true})
+		Expect(err).ShouldNot(HaveOccurred())
+
+		Expect(config.ClientConfig("me", "bastion.corp:22").HostKeyAlgorithms).Should(Equal([]string{ssh.KeyAlgoED25519}))
+		Expect(config.ClientConfig("me", "old.corp:2222").HostKeyAlgorithms).Should(ConsistOf(
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256,
+		))
+		Expect(config.ClientConfig("me", "unknown.corp:22").HostKeyAlgorithms).Should(BeNil())
+	})
+
+	It("should return an error without known_hosts", func() {
+		_, err := Load(Opts{KnownHosts: filepath.Join(dir, "missing"), IdentityFiles: []string{identityFile}, NoAgent: true})
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should return an error for identity files that can't be used", func() {
+		_, err := Load(Opts{KnownHosts: knownHostsFile, IdentityFiles: []string{filepath.Join(dir, "missing")}, NoAgent: true})
+		Expect(err).Should(HaveOccurred())
+
+		_, err = Load(Opts{KnownHosts: knownHostsFile, IdentityFiles: []string{knownHostsFile}, NoAgent: true})
+		Expect(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,71 @@
+/*
+Package tlsconfig builds the TLS client settings pacyak uses to reach HTTPS proxies and PAC servers.
+
+Corporate servers often have certificates from a private CA and may require clients to present a certificate of
+their own. The CA bundle is trusted in addition to the system roots.
+*/
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Opts holds TLS client settings as they appear in the config file
+type Opts struct {
+	// CAFile is a PEM bundle of CA certificates trusted in addition to the system roots
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM certificate and key presented to servers that ask for a client certificate
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// IsZero reports whether no settings are given, meaning the Go defaults apply
+func (o Opts) IsZero() bool {
+	return o == Opts{}
+}
+
+// Load reads the files named by opts and returns a client config using them.
+// It returns nil if opts is empty so callers get the Go defaults.
+func Load(opts Opts) (*tls.Config, error) {
+	if opts.IsZero() {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", opts.CAFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, fmt.Errorf("A client certificate needs both cert_file and key_file")
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,13 @@
+package tlsconfig_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTlsconfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tlsconfig Suite")
+}
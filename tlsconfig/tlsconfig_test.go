@@ -0,0 +1,148 @@
+package tlsconfig_test
+
+import (
+	. "github.com/mikesimons/pacyak/tlsconfig"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// issue creates a certificate for name signed by parent, or self-signed if parent is nil
+func issue(name string, parent *tls.Certificate, ca bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).ShouldNot(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writePEM writes the certificate and key of cert to dir and returns their paths
+func writePEM(dir, name string, cert tls.Certificate) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	Expect(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)).Should(Succeed())
+
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	Expect(err).ShouldNot(HaveOccurred())
+	Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)).Should(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("Tlsconfig", func() {
+	var dir string
+	var caFile, certFile, keyFile string
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pacyak-tls")
+		Expect(err).ShouldNot(HaveOccurred())
+
+		ca := issue("Corp CA", nil, true)
+		caFile, _ = writePEM(dir, "ca", ca)
+		certFile, keyFile = writePEM(dir, "client", issue("client", &ca, false))
+
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.Leaf)
+
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{issue("127.0.0.1", &ca, false)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	get := func(config *tls.Config) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		response, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		return string(body), err
+	}
+
+	It("should return nil without settings", func() {
+		Expect(Load(Opts{})).Should(BeNil())
+	})
+
+	It("should trust the CA bundle and present the client certificate", func() {
+		config, err := Load(Opts{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(get(config)).Should(Equal("client"))
+	})
+
+	It("should fail the handshake without the CA or client certificate", func() {
+		config, err := Load(Opts{CertFile: certFile, KeyFile: keyFile})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = get(config)
+		Expect(err).Should(HaveOccurred())
+
+		config, err = Load(Opts{CAFile: caFile})
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = get(config)
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should return an error for missing or invalid files", func() {
+		_, err := Load(Opts{CAFile: filepath.Join(dir, "missing.crt")})
+		Expect(err).Should(HaveOccurred())
+
+		_, err = Load(Opts{CAFile: keyFile})
+		Expect(err).Should(HaveOccurred())
+
+		_, err = Load(Opts{CertFile: certFile})
+		Expect(err).Should(HaveOccurred())
+	})
+})